@@ -0,0 +1,1089 @@
+package handlers
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/statements"
+	"tp_db_homework/src/utils"
+)
+
+const archiveVersion = 1
+
+// maxArchiveSize bounds the archive ForumImport reads
+const maxArchiveSize = 1 << 30
+
+// order of the files inside an archive, the import relies on the same order of entities
+var archiveFiles = []string{
+	"forum.json", "users.ndjson", "threads.ndjson", "posts.ndjson", "votes.ndjson", "members.ndjson", "invites.ndjson",
+	"polls.ndjson", "poll_votes.ndjson", "post_votes.ndjson", "attachments.ndjson",
+}
+
+// archiveBlobPrefix names the archive entries that hold the content of attachments, one per blob
+const archiveBlobPrefix = "blobs/"
+
+// archiveBlobKey returns the blob key of a blobs/<sha256> archive entry
+func archiveBlobKey(name string) (string, bool) {
+	key := strings.TrimPrefix(name, archiveBlobPrefix)
+	if key == name || len(key) != 2*sha256.Size {
+		return "", false
+	}
+	_, err := hex.DecodeString(key)
+	return strings.ToLower(key), err == nil
+}
+
+// archiveBlobVerify checks that an imported blob has the content its key names and returns its size and content type
+func archiveBlobVerify(f *os.File, key string) (int, string, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, "", err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, "", err
+	}
+	hash := sha256.New()
+	hash.Write(head[:n])
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != key {
+		return 0, "", errors.New("Blob " + key + " does not match its content")
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return n + int(size), http.DetectContentType(head[:n]), err
+}
+
+type archiveSection struct {
+	file  *os.File
+	enc   *json.Encoder
+	count int
+}
+
+func newArchiveSection() (*archiveSection, error) {
+	f, err := ioutil.TempFile("", "forum_export")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveSection{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *archiveSection) write(v interface{}) error {
+	s.count += 1
+	return s.enc.Encode(v)
+}
+
+func (s *archiveSection) close() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// archiveWriteRows writes what scan makes of every row to the section and closes rows
+func archiveWriteRows(rows *pgx.Rows, section *archiveSection, scan func(rows *pgx.Rows) (interface{}, error)) error {
+	defer rows.Close()
+	for rows.Next() {
+		v, err := scan(rows)
+		if err == nil {
+			err = section.write(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ForumExport writes the forum as a tar archive of JSON sections followed by the attachment files.
+// User emails are included for moderators only, without them the archive imports
+// where its users already exist.
+func ForumExport(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	tx, err := db.BeginEx(context.Background(), &pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	forum := models.Forum{}
+	err = tx.QueryRow("forum_get_by_slug", c.Param("slug")).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts, &forum.Private)
+	if err != nil || !forumVisible(db, forum.Slug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+	withEmails := forumModerator(db, forum.Slug, c.QueryParam("nickname"))
+
+	sections := make(map[string]*archiveSection)
+	for _, name := range archiveFiles {
+		section, err := newArchiveSection()
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		defer section.close()
+		sections[name] = section
+	}
+
+	err = sections["forum.json"].write(forum)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err := tx.Query(`
+        SELECT nickname, fullname, about, email
+        FROM users
+        WHERE nickname IN (
+            SELECT user_nickname FROM forums WHERE slug = $1
+            UNION SELECT author FROM threads WHERE forum = $1
+            UNION SELECT author FROM posts WHERE forum = $1
+        ) OR id IN (
+            SELECT v.user_id FROM thread_votes v INNER JOIN threads t ON t.id = v.thread_id WHERE t.forum = $1
+            UNION SELECT m.user_id FROM forum_members m INNER JOIN forums f ON f.id = m.forum_id WHERE f.slug = $1
+            UNION SELECT i.user_id FROM forum_invites i INNER JOIN forums f ON f.id = i.forum_id WHERE f.slug = $1
+            UNION SELECT i.invited_by FROM forum_invites i INNER JOIN forums f ON f.id = i.forum_id WHERE f.slug = $1
+            UNION SELECT v.user_id FROM poll_votes v
+                INNER JOIN polls p ON p.id = v.poll_id
+                INNER JOIN threads t ON t.id = p.thread_id
+            WHERE t.forum = $1
+            UNION SELECT v.user_id FROM post_votes v INNER JOIN posts p ON p.id = v.post_id WHERE p.forum = $1
+        )
+        ORDER BY id`,
+		forum.Slug,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = archiveWriteRows(rows, sections["users.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+		user := models.User{}
+		err := rows.Scan(&user.Nickname, &user.Fullname, &user.About, &user.Email)
+		if !withEmails {
+			user.Email = ""
+		}
+		return user, err
+	})
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err = tx.Query(fmt.Sprintf(`
+        SELECT %s
+        FROM threads
+        WHERE forum = $1 AND deleted_at IS NULL
+        ORDER BY id`,
+		statements.ThreadColumns),
+		forum.Slug,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = archiveWriteRows(rows, sections["threads.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+		thr := models.Thread{}
+		err := rows.Scan(threadFields(&thr)...)
+		return thr, err
+	})
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// a reply is always newer than its parent, so ordering by id writes parents first and keeps the creation order
+	rows, err = tx.Query(`
+        SELECT author, created, forum, id, message, thread, parent, is_edited, deleted_at IS NOT NULL, path
+        FROM posts
+        WHERE forum = $1 AND thread IN (SELECT id FROM threads WHERE forum = $1 AND deleted_at IS NULL)
+        ORDER BY id`,
+		forum.Slug,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = archiveWriteRows(rows, sections["posts.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+		post := models.ArchivePost{}
+		err := rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent, &post.IsEdited, &post.IsDeleted, &post.Path)
+		return post, err
+	})
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err = tx.Query(`
+        SELECT v.thread_id, u.nickname, v.voice
+        FROM thread_votes v
+            INNER JOIN threads t ON t.id = v.thread_id
+            INNER JOIN users u ON u.id = v.user_id
+        WHERE t.forum = $1 AND t.deleted_at IS NULL
+        ORDER BY v.id`,
+		forum.Slug,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = archiveWriteRows(rows, sections["votes.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+		vote := models.ThreadVote{}
+		err := rows.Scan(&vote.Thread, &vote.Nickname, &vote.Voice)
+		return vote, err
+	})
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	rows, err = tx.Query(`
+        SELECT u.nickname
+        FROM forum_members m
+            INNER JOIN forums f ON f.id = m.forum_id
+            INNER JOIN users u ON u.id = m.user_id
+        WHERE f.slug = $1
+        ORDER BY u.id`,
+		forum.Slug,
+	)
+	if err == nil {
+		err = archiveWriteRows(rows, sections["members.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+			member := models.ForumMember{}
+			err := rows.Scan(&member.Nickname)
+			return member, err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err = tx.Query(`
+        SELECT b.nickname, u.nickname
+        FROM forum_invites i
+            INNER JOIN forums f ON f.id = i.forum_id
+            INNER JOIN users u ON u.id = i.user_id
+            INNER JOIN users b ON b.id = i.invited_by
+        WHERE f.slug = $1
+        ORDER BY i.created`,
+		forum.Slug,
+	)
+	if err == nil {
+		err = archiveWriteRows(rows, sections["invites.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+			invite := models.ForumInvite{}
+			err := rows.Scan(&invite.Nickname, &invite.Invitee)
+			return invite, err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err = tx.Query(`
+        SELECT p.thread_id, p.id, p.question, p.multiple, p.closes_at,
+            ARRAY(SELECT id FROM poll_options WHERE poll_id = p.id ORDER BY position),
+            ARRAY(SELECT text FROM poll_options WHERE poll_id = p.id ORDER BY position)
+        FROM polls p
+            INNER JOIN threads t ON t.id = p.thread_id
+        WHERE t.forum = $1 AND t.deleted_at IS NULL
+        ORDER BY p.id`,
+		forum.Slug,
+	)
+	if err == nil {
+		err = archiveWriteRows(rows, sections["polls.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+			poll := models.ArchivePoll{}
+			var optionIds []int32
+			var optionTexts []string
+			err := rows.Scan(&poll.Thread, &poll.Id, &poll.Question, &poll.Multiple, &poll.Closes, &optionIds, &optionTexts)
+			for i := range optionIds {
+				poll.Options = append(poll.Options, models.PollOption{Id: int(optionIds[i]), Text: optionTexts[i]})
+			}
+			return poll, err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err = tx.Query(`
+        SELECT v.option_id, u.nickname
+        FROM poll_votes v
+            INNER JOIN polls p ON p.id = v.poll_id
+            INNER JOIN threads t ON t.id = p.thread_id
+            INNER JOIN users u ON u.id = v.user_id
+        WHERE t.forum = $1 AND t.deleted_at IS NULL
+        ORDER BY v.poll_id, v.option_id, u.id`,
+		forum.Slug,
+	)
+	if err == nil {
+		err = archiveWriteRows(rows, sections["poll_votes.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+			vote := models.ArchivePollVote{}
+			err := rows.Scan(&vote.Option, &vote.Nickname)
+			return vote, err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	rows, err = tx.Query(`
+        SELECT v.post_id, u.nickname, v.voice
+        FROM post_votes v
+            INNER JOIN posts p ON p.id = v.post_id
+            INNER JOIN threads t ON t.id = p.thread
+            INNER JOIN users u ON u.id = v.user_id
+        WHERE p.forum = $1 AND t.deleted_at IS NULL
+        ORDER BY v.post_id, u.id`,
+		forum.Slug,
+	)
+	if err == nil {
+		err = archiveWriteRows(rows, sections["post_votes.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+			vote := models.ArchivePostVote{}
+			err := rows.Scan(&vote.Post, &vote.Nickname, &vote.Voice)
+			return vote, err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// blobs are listed once each, in the order their first attachment comes
+	blobKeys := make([]string, 0)
+	blobSizes := make(map[string]int)
+	rows, err = tx.Query(fmt.Sprintf(`
+        SELECT a.post_id, a.uploader, %s
+        FROM attachments a
+            INNER JOIN blobs b ON b.sha256 = a.sha256
+            INNER JOIN posts p ON p.id = a.post_id
+            INNER JOIN threads t ON t.id = p.thread
+        WHERE p.forum = $1 AND t.deleted_at IS NULL
+        ORDER BY a.id`, attachmentColumns),
+		forum.Slug,
+	)
+	if err == nil {
+		err = archiveWriteRows(rows, sections["attachments.ndjson"], func(rows *pgx.Rows) (interface{}, error) {
+			attachment := models.ArchiveAttachment{}
+			err := rows.Scan(append([]interface{}{&attachment.Post, &attachment.Uploader}, attachmentFields(&attachment.Attachment)...)...)
+			if _, ok := blobSizes[attachment.Sha256]; err == nil && !ok {
+				blobKeys = append(blobKeys, attachment.Sha256)
+				blobSizes[attachment.Sha256] = attachment.Size
+			}
+			return attachment, err
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	tx.Rollback()
+
+	manifest := models.ArchiveManifest{
+		Version:  archiveVersion,
+		Forum:    forum.Slug,
+		Exported: time.Now(),
+		Counts:   make(map[string]int),
+	}
+	for _, name := range archiveFiles {
+		manifest.Counts[name] = sections[name].count
+	}
+	manifest.Counts[archiveBlobPrefix] = len(blobKeys)
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-tar")
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+forum.Slug+".tar\"")
+	c.Response().WriteHeader(http.StatusOK)
+
+	tw := tar.NewWriter(c.Response())
+	err = tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifestData)), ModTime: manifest.Exported})
+	if err == nil {
+		_, err = tw.Write(manifestData)
+	}
+	for _, name := range archiveFiles {
+		if err != nil {
+			break
+		}
+		section := sections[name]
+		var size int64
+		size, err = section.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			break
+		}
+		_, err = section.file.Seek(0, io.SeekStart)
+		if err != nil {
+			break
+		}
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: manifest.Exported})
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(tw, section.file)
+	}
+	for _, key := range blobKeys {
+		if err != nil {
+			break
+		}
+		var blob io.ReadCloser
+		blob, err = utils.Blobs.Get(key)
+		if err != nil {
+			break
+		}
+		err = tw.WriteHeader(&tar.Header{Name: archiveBlobPrefix + key, Mode: 0644, Size: int64(blobSizes[key]), ModTime: manifest.Exported})
+		if err == nil {
+			_, err = io.Copy(tw, blob)
+		}
+		blob.Close()
+	}
+	if err != nil {
+		// the status line is already sent, the client gets a truncated archive
+		log.Println(err)
+		return nil
+	}
+	return tw.Close()
+}
+
+// archiveReadError tells an archive over maxArchiveSize from a malformed one
+func archiveReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Archive is too large")
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// ForumImport creates a forum from an archive made by ForumExport. Only the owner of the archived forum,
+// ?nickname, can import it. Users that exist are kept as they are, missing ones are created
+// from the archive, which needs their emails for that.
+func ForumImport(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	nickname := c.QueryParam("nickname")
+	err := db.QueryRow(`SELECT nickname FROM users WHERE nickname = $1`, nickname).Scan(&nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxArchiveSize)
+	defer req.Body.Close()
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	tr := tar.NewReader(req.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archiveReadError(err)
+		}
+		name := hdr.Name
+		if key, isBlob := archiveBlobKey(name); isBlob {
+			if hdr.Size > utils.MaxAttachmentSize {
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Archive entry "+name+" is too large")
+			}
+			name = archiveBlobPrefix + key
+		} else if name != "manifest.json" && !utils.StringInList(name, archiveFiles) {
+			continue
+		}
+
+		f, err := ioutil.TempFile("", "forum_import")
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		files[name] = f
+		_, err = io.Copy(f, tr)
+		if err != nil {
+			return archiveReadError(err)
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+	if files["manifest.json"] == nil || files["forum.json"] == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Archive has no manifest or forum")
+	}
+
+	manifest := models.ArchiveManifest{}
+	err = json.NewDecoder(files["manifest.json"]).Decode(&manifest)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if manifest.Version != archiveVersion {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unsupported archive version")
+	}
+
+	forum := models.Forum{}
+	err = json.NewDecoder(files["forum.json"]).Decode(&forum)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if slug := c.QueryParam("slug"); len(slug) > 0 {
+		forum.Slug = slug
+	}
+	if !strings.EqualFold(forum.User, nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner of the forum can import it")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	newUsers := 0
+	if f := files["users.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			user := models.User{}
+			err := dec.Decode(&user)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			// existing profiles are never overwritten
+			var exists bool
+			err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE nickname = $1)`, user.Nickname).Scan(&exists)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			if exists {
+				continue
+			}
+			if len(user.Email) == 0 {
+				return echo.NewHTTPError(http.StatusConflict, "User "+user.Nickname+" does not exist and the archive has no email for them")
+			}
+
+			// a profile with the same email but another nickname makes the archive unimportable
+			tag, err := tx.Exec(`
+                INSERT INTO users (nickname, fullname, about, email) VALUES ($1, $2, $3, $4)
+                ON CONFLICT DO NOTHING`,
+				user.Nickname, user.Fullname, user.About, user.Email,
+			)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			if tag.RowsAffected() == 0 {
+				return echo.NewHTTPError(http.StatusConflict, "User "+user.Nickname+" conflicts with an existing profile")
+			}
+			newUsers++
+		}
+	}
+
+	var forumId int
+	err = tx.QueryRow("forum_get_id_by_slug", forum.Slug).Scan(&forumId)
+	if err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "Forum "+forum.Slug+" already exists")
+	}
+	err = tx.QueryRow(`
+        INSERT INTO forums (title, user_nickname, slug, is_private) VALUES ($1, $2, $3, $4)
+        RETURNING id, slug`,
+		forum.Title, forum.User, forum.Slug, forum.Private,
+	).Scan(&forumId, &forum.Slug)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	_, err = tx.Exec(`
+        INSERT INTO forum_members (forum_id, user_id)
+        SELECT $1, id FROM users WHERE nickname = $2`,
+		forumId, forum.User,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// sections added after the first archives may be missing, such archives import without them
+	if f := files["members.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			member := models.ForumMember{}
+			err := dec.Decode(&member)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			_, err = tx.Exec(`
+                INSERT INTO forum_members (forum_id, user_id)
+                SELECT $1, id FROM users WHERE nickname = $2
+                ON CONFLICT DO NOTHING`,
+				forumId, member.Nickname,
+			)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+		}
+	}
+
+	if f := files["invites.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			invite := models.ForumInvite{}
+			err := dec.Decode(&invite)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			_, err = tx.Exec(`
+                INSERT INTO forum_invites (forum_id, user_id, invited_by)
+                SELECT $1, u.id, b.id FROM users u, users b WHERE u.nickname = $2 AND b.nickname = $3
+                ON CONFLICT DO NOTHING`,
+				forumId, invite.Invitee, invite.Nickname,
+			)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+		}
+	}
+
+	threadIds := make(map[int]int)
+	if f := files["threads.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			thr := models.Thread{}
+			err := dec.Decode(&thr)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			// slugs are unique across forums, a taken one is replaced by a fresh slug and kept as its alias
+			var oldSlug string
+			if len(thr.Slug) > 0 {
+				var count int
+				err = tx.QueryRow(`
+                    SELECT
+                        (SELECT COUNT(*) FROM threads WHERE slug = $1) +
+                        (SELECT COUNT(*) FROM thread_slug_aliases WHERE slug = $1)`,
+					thr.Slug,
+				).Scan(&count)
+				if err == nil && count > 0 {
+					oldSlug = thr.Slug
+					thr.Slug, err = threadGenerateSlug(tx, oldSlug)
+				}
+				if err != nil {
+					log.Println(err)
+					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				}
+			}
+
+			var newId int
+			err = tx.QueryRow(`
+                INSERT INTO threads (forum, title, author, message, message_html, created, slug, pinned, locked, announcement, tags)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11::text[]::citext[])
+                RETURNING id`,
+				forum.Slug, thr.Title, thr.Author, thr.Message, utils.RenderMarkdown(thr.Message), thr.Created, thr.Slug,
+				thr.Pinned, thr.Locked, thr.Announcement, utils.NormalizeTags(thr.Tags),
+			).Scan(&newId)
+			if utils.IsUniqueViolation(err) {
+				return echo.NewHTTPError(http.StatusConflict, "Thread "+thr.Slug+" already exists")
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			threadIds[thr.Id] = newId
+
+			// an alias another thread already has is left to it
+			if len(oldSlug) > 0 {
+				_, err = tx.Exec(`
+                    INSERT INTO thread_slug_aliases (slug, thread_id) VALUES ($1, $2)
+                    ON CONFLICT (slug) DO NOTHING`,
+					oldSlug, newId,
+				)
+				if err != nil {
+					log.Println(err)
+					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				}
+			}
+		}
+	}
+
+	// posts come ordered by id, so parents are inserted before replies, new ids keep the creation order
+	// and update_path rebuilds paths
+	postIds := map[int]int{0: 0}
+	livePosts := 0
+	if f := files["posts.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			post := models.ArchivePost{}
+			err := dec.Decode(&post)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			threadId, ok := threadIds[post.Thread]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Post refers to a thread missing from the archive")
+			}
+			parentId, ok := postIds[post.Parent]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Post refers to a parent missing from the archive")
+			}
+
+			var newId int
+			err = tx.QueryRow(`
+                INSERT INTO posts (parent, author, message, message_html, is_edited, forum, thread, created, deleted_at)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CASE WHEN $9 THEN NOW() END)
+                RETURNING id`,
+				parentId, post.Author, post.Message, utils.RenderMarkdown(post.Message), post.IsEdited, forum.Slug, threadId,
+				post.Created, post.IsDeleted,
+			).Scan(&newId)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			postIds[post.Id] = newId
+			if !post.IsDeleted {
+				livePosts++
+				err = utils.SaveMentions(tx, []int{newId}, []string{post.Message})
+				if err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				}
+			}
+		}
+	}
+
+	if f := files["votes.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			vote := models.ThreadVote{}
+			err := dec.Decode(&vote)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			threadId, ok := threadIds[vote.Thread]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Vote refers to a thread missing from the archive")
+			}
+			_, err = tx.Exec(`
+                INSERT INTO thread_votes (thread_id, user_id, voice)
+                SELECT $1, id, $3 FROM users WHERE nickname = $2 AND $3 != 0`,
+				threadId, vote.Nickname, vote.Voice,
+			)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+	}
+
+	if f := files["post_votes.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			vote := models.ArchivePostVote{}
+			err := dec.Decode(&vote)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			postId, ok := postIds[vote.Post]
+			if !ok || vote.Post == 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "Vote refers to a post missing from the archive")
+			}
+			_, err = tx.Exec(`
+                INSERT INTO post_votes (post_id, user_id, voice)
+                SELECT $1, id, $3 FROM users WHERE nickname = $2 AND $3 != 0
+                ON CONFLICT DO NOTHING`,
+				postId, vote.Nickname, vote.Voice,
+			)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+	}
+
+	// blobs missing from the storage are written once the import is committed
+	newBlobs := make(map[string]*os.File)
+	if f := files["attachments.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			attachment := models.ArchiveAttachment{}
+			err := dec.Decode(&attachment)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			postId, ok := postIds[attachment.Post]
+			if !ok || attachment.Post == 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "Attachment refers to a post missing from the archive")
+			}
+			key, ok := archiveBlobKey(archiveBlobPrefix + attachment.Sha256)
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Attachment has an invalid checksum")
+			}
+
+			// the collector takes the same lock before it removes a blob
+			_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, key)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			stored, err := utils.Blobs.Exists(key)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			size, contentType := attachment.Size, attachment.ContentType
+			if !stored && newBlobs[key] == nil {
+				blob := files[archiveBlobPrefix+key]
+				if blob == nil {
+					return echo.NewHTTPError(http.StatusBadRequest, "Archive has no content for attachment "+attachment.Filename)
+				}
+				size, contentType, err = archiveBlobVerify(blob, key)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				}
+				newBlobs[key] = blob
+			}
+
+			_, err = tx.Exec(`
+                INSERT INTO blobs (sha256, size, content_type) VALUES ($1, $2, $3)
+                ON CONFLICT (sha256) DO NOTHING`,
+				key, size, contentType,
+			)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			_, err = tx.Exec(`
+                INSERT INTO attachments (sha256, filename, uploader, post_id, created)
+                VALUES ($1, $2, $3, $4, COALESCE($5, NOW()))`,
+				key, attachment.Filename, attachment.Uploader, postId, attachment.Created,
+			)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+	}
+
+	optionIds := make(map[int]int)
+	if f := files["polls.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			poll := models.ArchivePoll{}
+			err := dec.Decode(&poll)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			threadId, ok := threadIds[poll.Thread]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Poll refers to a thread missing from the archive")
+			}
+			archivedIds := make([]int, len(poll.Options))
+			for i := range poll.Options {
+				archivedIds[i] = poll.Options[i].Id
+			}
+			err = pollCreate(tx, threadId, &poll.Poll)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			for i := range poll.Options {
+				optionIds[archivedIds[i]] = poll.Options[i].Id
+			}
+		}
+	}
+
+	if f := files["poll_votes.ndjson"]; f != nil {
+		dec := json.NewDecoder(f)
+		for {
+			vote := models.ArchivePollVote{}
+			err := dec.Decode(&vote)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			optionId, ok := optionIds[vote.Option]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Poll vote refers to an option missing from the archive")
+			}
+			_, err = tx.Exec(`
+                INSERT INTO poll_votes (poll_id, option_id, user_id)
+                SELECT o.poll_id, o.id, u.id FROM poll_options o, users u WHERE o.id = $1 AND u.nickname = $2
+                ON CONFLICT DO NOTHING`,
+				optionId, vote.Nickname,
+			)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+	}
+
+	forum.Threads = len(threadIds)
+	forum.Posts = livePosts
+	_, err = tx.Exec(`
+        UPDATE forums SET threads = $2, posts = $3 WHERE id = $1`,
+		forumId, forum.Threads, forum.Posts,
+	)
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE threads t SET
+                votes = COALESCE((SELECT SUM(voice) FROM thread_votes WHERE thread_id = t.id), 0),
+                upvotes = (SELECT COUNT(*) FROM thread_votes WHERE thread_id = t.id AND voice > 0),
+                downvotes = (SELECT COUNT(*) FROM thread_votes WHERE thread_id = t.id AND voice < 0),
+                posts = (SELECT COUNT(*) FROM posts WHERE thread = t.id AND deleted_at IS NULL),
+                last_post_at = (SELECT MAX(created) FROM posts WHERE thread = t.id AND deleted_at IS NULL),
+                last_post_author = (
+                    SELECT author FROM posts WHERE thread = t.id AND deleted_at IS NULL ORDER BY created DESC, id DESC LIMIT 1
+                )
+            WHERE forum = $1`,
+			forum.Slug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE posts p SET score = COALESCE((SELECT SUM(voice) FROM post_votes WHERE post_id = p.id), 0)
+            WHERE forum = $1`,
+			forum.Slug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE poll_options o SET votes = (SELECT COUNT(*) FROM poll_votes WHERE option_id = o.id)
+            FROM polls p
+                INNER JOIN threads t ON t.id = p.thread_id
+            WHERE o.poll_id = p.id AND t.forum = $1`,
+			forum.Slug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            INSERT INTO forum_users (forum_id, user_id, posts, threads, first_active, last_active)
+            SELECT $1, u.id, SUM(a.posts), SUM(a.threads), MIN(a.created), MAX(a.created)
+            FROM (
+                SELECT author, 0 AS posts, 1 AS threads, created FROM threads WHERE forum = $2
+                UNION ALL
+                SELECT author, 1 AS posts, 0 AS threads, created FROM posts WHERE forum = $2 AND deleted_at IS NULL
+            ) a
+                INNER JOIN users u ON u.nickname = a.author
+            GROUP BY u.id`,
+			forumId, forum.Slug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            INSERT INTO forum_stats (forum_id, day, threads, posts)
+            SELECT $1, a.created::date, SUM(a.threads), SUM(a.posts)
+            FROM (
+                SELECT 0 AS posts, 1 AS threads, created FROM threads WHERE forum = $2
+                UNION ALL
+                SELECT 1 AS posts, 0 AS threads, created FROM posts WHERE forum = $2
+            ) a
+            GROUP BY a.created::date`,
+			forumId, forum.Slug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            INSERT INTO forum_stats_authors (forum_id, day, user_id)
+            SELECT DISTINCT $1::int, a.created::date, u.id
+            FROM (
+                SELECT author, created FROM threads WHERE forum = $2
+                UNION ALL
+                SELECT author, created FROM posts WHERE forum = $2
+            ) a
+                INNER JOIN users u ON u.nickname = a.author`,
+			forumId, forum.Slug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE status SET users = users + $1, forums = forums + 1, threads = threads + $2, posts = posts + $3`,
+			newUsers, forum.Threads, forum.Posts,
+		)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// as with uploads, the attachments keep the collector off the blobs until their files are written
+	for key, blob := range newBlobs {
+		_, err = blob.Seek(0, io.SeekStart)
+		if err == nil {
+			err = utils.Blobs.Put(key, blob)
+		}
+		if err != nil {
+			log.Println(err)
+			_, deleteErr := db.Exec(`
+                DELETE FROM attachments
+                WHERE sha256 = $1 AND post_id IN (SELECT id FROM posts WHERE forum = $2)`,
+				key, forum.Slug,
+			)
+			if deleteErr != nil {
+				log.Println(deleteErr)
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Forum was imported without some attachments: "+err.Error())
+		}
+	}
+
+	return c.JSON(http.StatusCreated, forum)
+}
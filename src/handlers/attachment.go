@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/utils"
+)
+
+const attachmentColumns = "a.id, a.filename, b.content_type, b.size, a.sha256, a.created"
+
+func attachmentFields(attachment *models.Attachment) []interface{} {
+	return []interface{}{
+		&attachment.Id, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.Sha256, &attachment.Created,
+	}
+}
+
+// attachmentFormOverhead is what a multipart upload may carry on top of the file: boundaries, headers and the nickname
+const attachmentFormOverhead = 64 << 10
+
+// AttachmentUpload stores the multipart "file" of the "nickname" user.
+// The content type is sniffed from the data, identical files share one blob.
+// The upload is removed by the collector unless a post claims it.
+func AttachmentUpload(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, utils.MaxAttachmentSize+attachmentFormOverhead)
+	_, err := c.MultipartForm()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "File is too large")
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	nickname := c.FormValue("nickname")
+	var userId int
+	err = db.QueryRow(`SELECT id FROM users WHERE nickname = $1`, nickname).Scan(&userId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if header.Size > utils.MaxAttachmentSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "File is too large")
+	}
+	file, err := header.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, utils.MaxAttachmentSize+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(data) > utils.MaxAttachmentSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "File is too large")
+	}
+	if len(data) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "File is empty")
+	}
+
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	filename := filepath.Base(header.Filename)
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = key
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	// the collector takes the same lock before it removes a blob
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, key)
+	if err == nil {
+		_, err = tx.Exec(`
+            INSERT INTO blobs (sha256, size, content_type) VALUES ($1, $2, $3)
+            ON CONFLICT (sha256) DO NOTHING`,
+			key, len(data), http.DetectContentType(data),
+		)
+	}
+
+	attachment := models.Attachment{}
+	if err == nil {
+		err = tx.QueryRow(fmt.Sprintf(`
+            WITH a AS (
+                INSERT INTO attachments (sha256, filename, uploader) VALUES ($1, $2, $3)
+                RETURNING id, filename, sha256, created
+            )
+            SELECT %s
+            FROM a
+                INNER JOIN blobs b ON b.sha256 = a.sha256`, attachmentColumns),
+			key, filename, nickname,
+		).Scan(attachmentFields(&attachment)...)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// the file is written after the commit so a rolled back upload leaves no file behind,
+	// meanwhile the attachment keeps the collector off the blob
+	stored, err := utils.Blobs.Exists(key)
+	if err == nil && !stored {
+		err = utils.Blobs.Put(key, bytes.NewReader(data))
+	}
+	if err != nil {
+		log.Println(err)
+		_, deleteErr := db.Exec(`DELETE FROM attachments WHERE id = $1`, attachment.Id)
+		if deleteErr != nil {
+			log.Println(deleteErr)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, attachment)
+}
+
+// AttachmentDownload serves an attachment to those who can see its post.
+// An upload that is not attached yet is visible to its uploader only.
+func AttachmentDownload(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	attachmentId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	nickname := c.QueryParam("nickname")
+
+	attachment := models.Attachment{}
+	var uploader string
+	var postId *int
+	err = db.QueryRow(fmt.Sprintf(`
+        SELECT %s, a.uploader, a.post_id
+        FROM attachments a
+            INNER JOIN blobs b ON b.sha256 = a.sha256
+        WHERE a.id = $1`, attachmentColumns),
+		attachmentId,
+	).Scan(append(attachmentFields(&attachment), &uploader, &postId)...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Attachment was not found!")
+	}
+
+	if postId == nil {
+		if !strings.EqualFold(uploader, nickname) {
+			return echo.NewHTTPError(http.StatusNotFound, "Attachment was not found!")
+		}
+	} else {
+		forumSlug, deleted, err := postGetThread(db, *postId)
+		if err != nil || !threadVisible(db, forumSlug, deleted, nickname) {
+			return echo.NewHTTPError(http.StatusNotFound, "Attachment was not found!")
+		}
+	}
+
+	blob, err := utils.Blobs.Get(attachment.Sha256)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer blob.Close()
+
+	// only images are shown inline, anything else is offered as a download
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	header := c.Response().Header()
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	header.Set("Content-Length", strconv.Itoa(attachment.Size))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(24*time.Hour/time.Second)))
+	return c.Stream(http.StatusOK, attachment.ContentType, blob)
+}
+
+// postAttachFiles claims the uploads listed in a new post for it and fills in their metadata.
+// It reports false if one of them does not exist, belongs to someone else or is already attached.
+func postAttachFiles(tx *pgx.Tx, post *models.Post) (bool, error) {
+	if len(post.Attachments) == 0 {
+		return true, nil
+	}
+
+	attachmentIds := make([]int, 0, len(post.Attachments))
+	for _, attachment := range post.Attachments {
+		if !utils.IntInList(attachment.Id, attachmentIds) {
+			attachmentIds = append(attachmentIds, attachment.Id)
+		}
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
+        WITH a AS (
+            UPDATE attachments SET post_id = $1
+            WHERE id = ANY($2::int[]) AND post_id IS NULL AND uploader = $3
+            RETURNING id, filename, sha256, created
+        )
+        SELECT %s
+        FROM a
+            INNER JOIN blobs b ON b.sha256 = a.sha256
+        ORDER BY a.id`, attachmentColumns),
+		post.Id, attachmentIds, post.Author,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	post.Attachments = make([]models.Attachment, 0, len(attachmentIds))
+	for rows.Next() {
+		attachment := models.Attachment{}
+		err = rows.Scan(attachmentFields(&attachment)...)
+		if err != nil {
+			return false, err
+		}
+		post.Attachments = append(post.Attachments, attachment)
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	return len(post.Attachments) == len(attachmentIds), nil
+}
+
+func postsLoadAttachments(db *pgx.ConnPool, posts []models.Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	postIds := make([]int, 0, len(posts))
+	for _, post := range posts {
+		postIds = append(postIds, post.Id)
+	}
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT a.post_id, %s
+        FROM attachments a
+            INNER JOIN blobs b ON b.sha256 = a.sha256
+        WHERE a.post_id = ANY($1::int[])
+        ORDER BY a.id`, attachmentColumns),
+		postIds,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	attachments := make(map[int][]models.Attachment)
+	for rows.Next() {
+		var postId int
+		attachment := models.Attachment{}
+		err = rows.Scan(append([]interface{}{&postId}, attachmentFields(&attachment)...)...)
+		if err != nil {
+			return err
+		}
+		attachments[postId] = append(attachments[postId], attachment)
+	}
+
+	for i := range posts {
+		posts[i].Attachments = attachments[posts[i].Id]
+	}
+	return rows.Err()
+}
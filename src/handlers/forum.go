@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/labstack/echo/v4"
@@ -13,6 +16,20 @@ import (
 	"tp_db_homework/src/utils"
 )
 
+// forumVisible reports whether the forum exists and its content may be shown to nickname.
+// Callers answer 404 otherwise, so that slugs of private forums are not leaked.
+func forumVisible(db *pgx.ConnPool, forumSlug string, nickname string) bool {
+	var visible bool
+	err := db.QueryRow("forum_is_visible", forumSlug, nickname).Scan(&visible)
+	return err == nil && visible
+}
+
+func forumModerator(db *pgx.ConnPool, forumSlug string, nickname string) bool {
+	var moderator bool
+	err := db.QueryRow("forum_is_moderator", forumSlug, nickname).Scan(&moderator)
+	return err == nil && moderator
+}
+
 func ForumCreate(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 
@@ -35,23 +52,33 @@ func ForumCreate(c echo.Context) error {
 	}
 
 	err = db.QueryRow(`
-        SELECT title, user_nickname, slug
+        SELECT title, user_nickname, slug, is_private
         FROM forums
-        WHERE slug = $1`,
+        WHERE slug = $1 OR id = (SELECT forum_id FROM forum_slug_aliases WHERE slug = $1)`,
 		newForum.Slug,
-	).Scan(&newForum.Title, &newForum.User, &newForum.Slug)
+	).Scan(&newForum.Title, &newForum.User, &newForum.Slug, &newForum.Private)
 	if err == nil {
+		if newForum.Private {
+			return c.JSON(409, models.Forum{Slug: newForum.Slug, Private: true})
+		}
 		return c.JSON(409, newForum)
 	}
 
-	_, err = db.Exec(`
-        INSERT INTO forums (title, user_nickname, slug) VALUES ($1, $2, $3)`,
-		newForum.Title, newForum.User, newForum.Slug,
-	)
+	var forumId int
+	err = db.QueryRow(`
+        INSERT INTO forums (title, user_nickname, slug, is_private) VALUES ($1, $2, $3, $4)
+        RETURNING id`,
+		newForum.Title, newForum.User, newForum.Slug, newForum.Private,
+	).Scan(&forumId)
 	if err != nil {
 		log.Println(err)
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	db.Exec(`
+        INSERT INTO forum_members (forum_id, user_id)
+        SELECT $1, id FROM users WHERE nickname = $2`,
+		forumId, newForum.User,
+	)
 	db.Exec(`UPDATE status SET forums = forums + 1`)
 
 	return c.JSON(http.StatusCreated, newForum)
@@ -63,8 +90,8 @@ func ForumDetails(c echo.Context) error {
 	forum := models.Forum{}
 	forum.Slug = c.Param("slug")
 
-	err := db.QueryRow("forum_get_by_slug", forum.Slug).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts)
-	if err != nil {
+	err := db.QueryRow("forum_get_by_slug", forum.Slug).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts, &forum.Private)
+	if err != nil || forum.Private && !forumVisible(db, forum.Slug, c.QueryParam("nickname")) {
 		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
 	}
 
@@ -86,11 +113,26 @@ func ForumUsers(c echo.Context) error {
 	}
 
 	since := c.QueryParam("since")
+	if len(c.QueryParam("cursor")) > 0 {
+		cursor, err := utils.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil || len(cursor.Nickname) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		since = cursor.Nickname
+	}
+
+	sort := c.QueryParam("sort")
+	if len(sort) == 0 {
+		sort = "nickname"
+	}
+	if !utils.StringInList(sort, []string{"nickname", "posts", "last_active"}) {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be nickname, posts or last_active")
+	}
 
 	var forumId int
 	err = db.QueryRow("forum_get_id_by_slug", forumSlug).Scan(&forumId)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	if err != nil || !forumVisible(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
 	}
 
 	hasSince := len(since) > 0
@@ -101,20 +143,433 @@ func ForumUsers(c echo.Context) error {
 
 	var rows *pgx.Rows
 	if hasSince {
-		rows, err = db.Query("forum_users_"+orderStr+"_since", forumId, limit, since)
+		rows, err = db.Query("forum_users_"+sort+"_"+orderStr+"_since", forumId, limit, since)
 	} else {
-		rows, err = db.Query("forum_users_"+orderStr, forumId, limit)
+		rows, err = db.Query("forum_users_"+sort+"_"+orderStr, forumId, limit)
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
 	defer rows.Close()
 
-	users := make([]models.User, 0)
+	users := make([]models.ForumUser, 0)
 	for rows.Next() {
-		user := models.User{}
-		rows.Scan(&user.About, &user.Email, &user.Fullname, &user.Nickname)
+		user := models.ForumUser{}
+		rows.Scan(&user.About, &user.Email, &user.Fullname, &user.Nickname, &user.Posts, &user.Threads, &user.FirstActive, &user.LastActive)
 		users = append(users, user)
 	}
+
+	if limit > 0 && len(users) == limit {
+		c.Response().Header().Set(utils.CursorHeader, utils.EncodeCursor(utils.Cursor{Nickname: users[len(users)-1].Nickname}))
+	}
 	return c.JSON(http.StatusOK, users)
 }
+
+// ForumPosts lists the posts of all threads of a forum, newest first.
+// ?author keeps the posts of one user, ?from and ?to (RFC 3339) bound their creation time
+// and ?thread_title=true adds the title of the thread to every post.
+// Moderators also see posts of deleted threads, removed posts are never listed.
+func ForumPosts(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = 100
+	}
+	withTitle, _ := strconv.ParseBool(c.QueryParam("thread_title"))
+
+	forumSlug := c.Param("slug")
+	err = db.QueryRow("forum_get_slug_by_slug", forumSlug).Scan(&forumSlug)
+	if err != nil || !forumVisible(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found")
+	}
+
+	conditions := []string{"p.forum = $1", "p.deleted_at IS NULL"}
+	params := []interface{}{forumSlug, limit}
+	addCondition := func(condition string, values ...interface{}) {
+		for _, value := range values {
+			params = append(params, value)
+			condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(params)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if !forumModerator(db, forumSlug, c.QueryParam("nickname")) {
+		addCondition("t.deleted_at IS NULL")
+	}
+	if author := c.QueryParam("author"); len(author) > 0 {
+		addCondition("p.author = ?", author)
+	}
+	for _, bound := range []struct{ param, condition string }{{"from", "p.created >= ?"}, {"to", "p.created < ?"}} {
+		if len(c.QueryParam(bound.param)) == 0 {
+			continue
+		}
+		value, err := time.Parse(time.RFC3339, c.QueryParam(bound.param))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, bound.param+" must be an RFC 3339 time")
+		}
+		addCondition(bound.condition, value)
+	}
+
+	if len(c.QueryParam("cursor")) > 0 {
+		cursor, err := utils.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil || cursor.Id == 0 || cursor.Created == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		addCondition("(p.created, p.id) < (?, ?)", *cursor.Created, cursor.Id)
+	} else if since, err := strconv.Atoi(c.QueryParam("since")); err == nil && since > 0 {
+		addCondition("(p.created, p.id) < (SELECT created, id FROM posts WHERE id = ?)", since)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT p.author, p.created, p.forum, p.id, p.message, p.thread, p.parent, p.is_edited, p.score, t.title
+        FROM posts p
+            INNER JOIN threads t ON t.id = p.thread
+        WHERE %s
+        ORDER BY p.created DESC, p.id DESC
+        LIMIT $2`,
+		strings.Join(conditions, " AND ")),
+		params...,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	posts := make([]models.Post, 0)
+	for rows.Next() {
+		post := models.Post{}
+		var title string
+		err = rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent, &post.IsEdited, &post.Score, &title)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if withTitle {
+			post.ThreadTitle = title
+		}
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if limit > 0 && len(posts) == limit {
+		last := posts[len(posts)-1]
+		c.Response().Header().Set(utils.CursorHeader, utils.EncodeCursor(utils.Cursor{Created: &last.Created, Id: last.Id}))
+	}
+
+	err = postsApplyMarkup(db, posts, markup)
+	if err == nil {
+		err = postsLoadAttachments(db, posts)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, posts)
+}
+
+func ForumRename(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	rename := models.SlugRename{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&rename)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(rename.Slug) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "New slug is empty")
+	}
+
+	forumSlug := c.Param("slug")
+	err = db.QueryRow("forum_get_slug_by_slug", forumSlug).Scan(&forumSlug)
+	if err != nil || !forumVisible(db, forumSlug, rename.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+	if !forumModerator(db, forumSlug, rename.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the owner can rename the forum")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var forumId int
+	var oldSlug string
+	err = tx.QueryRow("forum_get_id_by_slug", forumSlug).Scan(&forumId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+	err = tx.QueryRow(`
+        SELECT slug FROM forums WHERE id = $1 FOR UPDATE`,
+		forumId,
+	).Scan(&oldSlug)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+
+	var count int
+	err = tx.QueryRow(`
+        SELECT
+            (SELECT COUNT(*) FROM forums WHERE slug = $1 AND id != $2) +
+            (SELECT COUNT(*) FROM forum_slug_aliases WHERE slug = $1 AND forum_id != $2)`,
+		rename.Slug, forumId,
+	).Scan(&count)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+	}
+
+	// renaming back to one of the old slugs turns the alias into the live slug again
+	_, err = tx.Exec(`DELETE FROM forum_slug_aliases WHERE slug = $1`, rename.Slug)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// threads.forum and posts.forum follow by ON UPDATE CASCADE
+	forum := models.Forum{}
+	err = tx.QueryRow(`
+        UPDATE forums SET slug = $2 WHERE id = $1
+        RETURNING slug, title, user_nickname, threads, posts, is_private`,
+		forumId, rename.Slug,
+	).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts, &forum.Private)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if !strings.EqualFold(oldSlug, forum.Slug) {
+		_, err = tx.Exec(`
+            INSERT INTO forum_slug_aliases (slug, forum_id) VALUES ($1, $2)`,
+			oldSlug, forumId,
+		)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, forum)
+}
+
+func ForumStats(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+	forumSlug := c.Param("slug")
+
+	bucket := c.QueryParam("bucket")
+	if len(bucket) == 0 {
+		bucket = "day"
+	}
+	if bucket != "day" && bucket != "week" {
+		return echo.NewHTTPError(http.StatusBadRequest, "bucket must be day or week")
+	}
+
+	// activity is bucketed by CURRENT_DATE, so today is the database's today as well
+	var to time.Time
+	var err error
+	if len(c.QueryParam("to")) > 0 {
+		to, err = time.Parse("2006-01-02", c.QueryParam("to"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	} else {
+		err = db.QueryRow(`SELECT CURRENT_DATE`).Scan(&to)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if len(c.QueryParam("from")) > 0 {
+		from, err = time.Parse("2006-01-02", c.QueryParam("from"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if from.After(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from is after to")
+	}
+	if to.Sub(from) > 366*24*time.Hour {
+		return echo.NewHTTPError(http.StatusBadRequest, "Range is longer than a year")
+	}
+
+	var forumId int
+	err = db.QueryRow("forum_get_id_by_slug", forumSlug).Scan(&forumId)
+	if err != nil || !forumVisible(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+
+	rows, err := db.Query("forum_stats", forumId, from, to, bucket)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	stats := make([]models.ForumStats, 0)
+	for rows.Next() {
+		st := models.ForumStats{}
+		var day time.Time
+		err := rows.Scan(&day, &st.Threads, &st.Posts, &st.Votes, &st.Authors)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		st.Bucket = day.Format("2006-01-02")
+		stats = append(stats, st)
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+func ForumInvite(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+	forumSlug := c.Param("slug")
+
+	invite := models.ForumInvite{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&invite)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var forumId int
+	err = db.QueryRow("forum_get_id_by_slug", forumSlug).Scan(&forumId)
+	if err != nil || !forumVisible(db, forumSlug, invite.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+
+	var inviterId, inviteeId int
+	err = db.QueryRow("SELECT id, nickname FROM users WHERE nickname = $1", invite.Nickname).Scan(&inviterId, &invite.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+	err = db.QueryRow("SELECT id, nickname FROM users WHERE nickname = $1", invite.Invitee).Scan(&inviteeId, &invite.Invitee)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO forum_invites (forum_id, user_id, invited_by) VALUES ($1, $2, $3)
+        ON CONFLICT (forum_id, user_id) DO UPDATE SET invited_by = EXCLUDED.invited_by, created = NOW()`,
+		forumId, inviteeId, inviterId,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, invite)
+}
+
+func ForumJoin(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	member := models.ForumMember{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&member)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	forum := models.Forum{}
+	err = db.QueryRow("forum_get_by_slug", c.Param("slug")).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts, &forum.Private)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+
+	var forumId, userId int
+	err = db.QueryRow("forum_get_id_by_slug", forum.Slug).Scan(&forumId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+	err = db.QueryRow("SELECT id, nickname FROM users WHERE nickname = $1", member.Nickname).Scan(&userId, &member.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	if forum.Private {
+		tag, err := tx.Exec(`
+            DELETE FROM forum_invites WHERE forum_id = $1 AND user_id = $2`,
+			forumId, userId,
+		)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if tag.RowsAffected() == 0 && !forumVisible(db, forum.Slug, member.Nickname) {
+			return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+		}
+	}
+
+	_, err = tx.Exec("forum_members_add", forumId, userId)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, forum)
+}
+
+func ForumLeave(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+	forumSlug := c.Param("slug")
+
+	member := models.ForumMember{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&member)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	forum := models.Forum{}
+	err = db.QueryRow("forum_get_by_slug", forumSlug).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts, &forum.Private)
+	if err != nil || !forumVisible(db, forum.Slug, member.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum not found")
+	}
+	if strings.EqualFold(forum.User, member.Nickname) {
+		return echo.NewHTTPError(http.StatusConflict, "Forum owner can not leave the forum")
+	}
+
+	_, err = db.Exec(`
+        DELETE FROM forum_members
+        WHERE forum_id = (SELECT id FROM forums WHERE slug = $1) AND user_id = (SELECT id FROM users WHERE nickname = $2)`,
+		forum.Slug, member.Nickname,
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, member)
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/statements"
+	"tp_db_homework/src/utils"
+)
+
+// revisionEditor resolves the nickname of whoever makes an edit; anonymous edits have no editor
+func revisionEditor(db *pgx.ConnPool, nickname string) (*string, error) {
+	if len(nickname) == 0 {
+		return nil, nil
+	}
+	err := db.QueryRow(`SELECT nickname FROM users WHERE nickname = $1`, nickname).Scan(&nickname)
+	if err != nil {
+		return nil, err
+	}
+	return &nickname, nil
+}
+
+func threadSaveRevision(tx *pgx.Tx, threadId int, editor *string, title string, message string) error {
+	_, err := tx.Exec(`
+        INSERT INTO thread_revisions (thread_id, editor, title, message) VALUES ($1, $2, $3, $4)`,
+		threadId, editor, title, message,
+	)
+	return err
+}
+
+func postSaveRevision(tx *pgx.Tx, postId int, editor *string, message string) error {
+	_, err := tx.Exec(`
+        INSERT INTO post_revisions (post_id, editor, message) VALUES ($1, $2, $3)`,
+		postId, editor, message,
+	)
+	return err
+}
+
+// threadRevisionText is what thread diffs are made of
+func threadRevisionText(title string, message string) string {
+	return title + "\n\n" + message
+}
+
+// revisionDiffs fills each revision with the diff to the content that replaced it:
+// the next revision or, for the last one, the current content
+func revisionDiffs(revisions []models.Revision, text func(models.Revision) string, current string) {
+	for i := range revisions {
+		next, nextName := current, "current"
+		if i+1 < len(revisions) {
+			next, nextName = text(revisions[i+1]), fmt.Sprintf("revision %d", revisions[i+1].Id)
+		}
+		revisions[i].Diff = utils.UnifiedDiff(fmt.Sprintf("revision %d", revisions[i].Id), nextName, text(revisions[i]), next)
+	}
+}
+
+func ThreadHistory(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	var title, message string
+	err = db.QueryRow(`SELECT title, message FROM threads WHERE id = $1`, threadId).Scan(&title, &message)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	rows, err := db.Query(`
+        SELECT id, COALESCE(editor, ''), created, title, message FROM thread_revisions
+        WHERE thread_id = $1
+        ORDER BY id`,
+		threadId,
+	)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	revisions := make([]models.Revision, 0)
+	for rows.Next() {
+		rev := models.Revision{}
+		err = rows.Scan(&rev.Id, &rev.Editor, &rev.Created, &rev.Title, &rev.Message)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		revisions = append(revisions, rev)
+	}
+
+	revisionDiffs(revisions, func(rev models.Revision) string {
+		return threadRevisionText(rev.Title, rev.Message)
+	}, threadRevisionText(title, message))
+	return c.JSON(http.StatusOK, revisions)
+}
+
+func ThreadRevert(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	revisionId, err := strconv.Atoi(c.Param("revision"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	moderator := models.ThreadModerator{}
+	defer c.Request().Body.Close()
+	err = json.NewDecoder(c.Request().Body).Decode(&moderator)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, moderator.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, moderator.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can revert edits")
+	}
+	editor, err := revisionEditor(db, moderator.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var title, message string
+	err = tx.QueryRow(`
+        SELECT title, message FROM thread_revisions WHERE id = $1 AND thread_id = $2`,
+		revisionId, threadId,
+	).Scan(&title, &message)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Revision was not found!")
+	}
+
+	var oldTitle, oldMessage string
+	err = tx.QueryRow(`
+        SELECT title, message FROM threads WHERE id = $1 FOR UPDATE`,
+		threadId,
+	).Scan(&oldTitle, &oldMessage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	err = threadSaveRevision(tx, threadId, editor, oldTitle, oldMessage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	thr := models.Thread{}
+	err = tx.QueryRow(fmt.Sprintf(`
+        UPDATE threads SET title = $2, message = $3, message_html = $4
+        WHERE id = $1
+        RETURNING %s`,
+		statements.ThreadColumns),
+		threadId, title, message, utils.RenderMarkdown(message),
+	).Scan(threadFields(&thr)...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, thr)
+}
+
+// postGetThread finds the forum and the thread of a post to check who can see it
+func postGetThread(db *pgx.ConnPool, postId int) (string, *time.Time, error) {
+	var threadId int
+	var forumSlug string
+	var deleted *time.Time
+	err := db.QueryRow(`SELECT thread FROM posts WHERE id = $1`, postId).Scan(&threadId)
+	if err != nil {
+		return forumSlug, deleted, err
+	}
+	err = db.QueryRow("thread_get_forum_by_id", threadId).Scan(&forumSlug, &deleted)
+	return forumSlug, deleted, err
+}
+
+func PostHistory(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+
+	var message string
+	err = db.QueryRow(`SELECT message FROM posts WHERE id = $1`, postId).Scan(&message)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+
+	rows, err := db.Query(`
+        SELECT id, COALESCE(editor, ''), created, message FROM post_revisions
+        WHERE post_id = $1
+        ORDER BY id`,
+		postId,
+	)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	revisions := make([]models.Revision, 0)
+	for rows.Next() {
+		rev := models.Revision{}
+		err = rows.Scan(&rev.Id, &rev.Editor, &rev.Created, &rev.Message)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		revisions = append(revisions, rev)
+	}
+
+	revisionDiffs(revisions, func(rev models.Revision) string {
+		return rev.Message
+	}, message)
+	return c.JSON(http.StatusOK, revisions)
+}
+
+func PostRevert(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	revisionId, err := strconv.Atoi(c.Param("revision"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	moderator := models.ThreadModerator{}
+	defer c.Request().Body.Close()
+	err = json.NewDecoder(c.Request().Body).Decode(&moderator)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, moderator.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	if !forumModerator(db, forumSlug, moderator.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can revert edits")
+	}
+	editor, err := revisionEditor(db, moderator.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var message string
+	err = tx.QueryRow(`
+        SELECT message FROM post_revisions WHERE id = $1 AND post_id = $2`,
+		revisionId, postId,
+	).Scan(&message)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Revision was not found!")
+	}
+
+	// a tombstone keeps no text to revert to
+	var oldMessage string
+	err = tx.QueryRow(`SELECT message FROM posts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, postId).Scan(&oldMessage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	err = postSaveRevision(tx, postId, editor, oldMessage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	post := models.Post{}
+	err = tx.QueryRow(`
+        UPDATE posts SET message = $2, message_html = $3, is_edited = true
+        WHERE id = $1
+        RETURNING author, created, forum, id, message, thread, is_edited, parent, score`,
+		postId, message, utils.RenderMarkdown(message),
+	).Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited, &post.Parent, &post.Score)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	err = utils.SaveMentions(tx, []int{post.Id}, []string{post.Message})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, post)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/utils"
+)
+
+// markupMode reads ?markup: raw keeps messages as written, html replaces them with the rendered HTML
+// and both adds the HTML as messageHtml
+func markupMode(c echo.Context) (string, error) {
+	mode := c.QueryParam("markup")
+	if len(mode) == 0 {
+		return "raw", nil
+	}
+	if !utils.StringInList(mode, []string{"raw", "html", "both"}) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "markup must be raw, html or both")
+	}
+	return mode, nil
+}
+
+func applyMarkup(mode string, message *string, messageHtml *string, rendered string) {
+	if mode == "html" {
+		*message = rendered
+	} else if mode == "both" {
+		*messageHtml = rendered
+	}
+}
+
+func postsApplyMarkup(db *pgx.ConnPool, posts []models.Post, mode string) error {
+	if mode == "raw" || len(posts) == 0 {
+		return nil
+	}
+
+	postIds := make([]int, 0, len(posts))
+	for _, post := range posts {
+		postIds = append(postIds, post.Id)
+	}
+	rows, err := db.Query(`SELECT id, message_html FROM posts WHERE id = ANY($1::int[])`, postIds)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rendered := make(map[int]string, len(posts))
+	for rows.Next() {
+		var postId int
+		var messageHtml string
+		err = rows.Scan(&postId, &messageHtml)
+		if err != nil {
+			return err
+		}
+		rendered[postId] = messageHtml
+	}
+
+	for i := range posts {
+		applyMarkup(mode, &posts[i].Message, &posts[i].MessageHtml, rendered[posts[i].Id])
+	}
+	return rows.Err()
+}
+
+func threadApplyMarkup(db *pgx.ConnPool, thr *models.Thread, mode string) error {
+	if mode == "raw" {
+		return nil
+	}
+
+	var messageHtml string
+	err := db.QueryRow(`SELECT message_html FROM threads WHERE id = $1`, thr.Id).Scan(&messageHtml)
+	if err != nil {
+		return err
+	}
+	applyMarkup(mode, &thr.Message, &thr.MessageHtml, messageHtml)
+	return nil
+}
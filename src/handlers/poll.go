@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/utils"
+)
+
+const maxPollOptions = 20
+
+// pollValidate checks a poll sent along with a new thread
+func pollValidate(poll *models.Poll) error {
+	poll.Question = strings.TrimSpace(poll.Question)
+	if len(poll.Question) == 0 {
+		return errors.New("Poll question is empty")
+	}
+	if len(poll.Options) < 2 || len(poll.Options) > maxPollOptions {
+		return fmt.Errorf("Poll must have from 2 to %d options", maxPollOptions)
+	}
+	for i := range poll.Options {
+		poll.Options[i].Text = strings.TrimSpace(poll.Options[i].Text)
+		if len(poll.Options[i].Text) == 0 {
+			return errors.New("Poll option is empty")
+		}
+	}
+	if poll.Closes != nil && !poll.Closes.After(time.Now()) {
+		return errors.New("Poll closes in the past")
+	}
+	return nil
+}
+
+// pollCreate attaches a validated poll to a thread and fills in its ids
+func pollCreate(tx *pgx.Tx, threadId int, poll *models.Poll) error {
+	err := tx.QueryRow(`
+        INSERT INTO polls (thread_id, question, multiple, closes_at) VALUES ($1, $2, $3, $4)
+        RETURNING id`,
+		threadId, poll.Question, poll.Multiple, poll.Closes,
+	).Scan(&poll.Id)
+	if err != nil {
+		return err
+	}
+
+	for i := range poll.Options {
+		err = tx.QueryRow(`
+            INSERT INTO poll_options (poll_id, position, text) VALUES ($1, $2, $3)
+            RETURNING id`,
+			poll.Id, i, poll.Options[i].Text,
+		).Scan(&poll.Options[i].Id)
+		if err != nil {
+			return err
+		}
+		poll.Options[i].Votes = nil
+	}
+	return nil
+}
+
+// threadPoll loads the poll of a thread as nickname sees it; threads without a poll give nil
+func threadPoll(db *pgx.ConnPool, threadId int, nickname string) (*models.Poll, error) {
+	poll := models.Poll{}
+	voters := 0
+	err := db.QueryRow(`
+        SELECT id, question, multiple, closes_at, COALESCE(closes_at <= NOW(), false),
+            EXISTS(
+                SELECT 1 FROM poll_votes v INNER JOIN users u ON u.id = v.user_id
+                WHERE v.poll_id = p.id AND u.nickname = $2
+            ),
+            (SELECT COUNT(DISTINCT user_id) FROM poll_votes WHERE poll_id = p.id)
+        FROM polls p
+        WHERE thread_id = $1`,
+		threadId, nickname,
+	).Scan(&poll.Id, &poll.Question, &poll.Multiple, &poll.Closes, &poll.Closed, &poll.Voted, &voters)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	showResults := poll.Voted || poll.Closed
+	if showResults {
+		poll.Voters = &voters
+	}
+
+	rows, err := db.Query(`
+        SELECT id, text, votes FROM poll_options
+        WHERE poll_id = $1
+        ORDER BY position`,
+		poll.Id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	poll.Options = make([]models.PollOption, 0)
+	for rows.Next() {
+		option := models.PollOption{}
+		votes := 0
+		err = rows.Scan(&option.Id, &option.Text, &votes)
+		if err != nil {
+			return nil, err
+		}
+		if showResults {
+			option.Votes = &votes
+		}
+		poll.Options = append(poll.Options, option)
+	}
+	return &poll, rows.Err()
+}
+
+func PollVote(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	vote := models.PollVote{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&vote)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, vote.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	var userId int
+	err = db.QueryRow(`
+        SELECT id, nickname FROM users WHERE nickname = $1`,
+		vote.Nickname,
+	).Scan(&userId, &vote.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	// the poll row lock makes the has-voted check and the ballot atomic
+	var pollId int
+	var multiple, closed, locked bool
+	err = tx.QueryRow(`
+        SELECT p.id, p.multiple, COALESCE(p.closes_at <= NOW(), false), t.locked
+        FROM polls p
+            INNER JOIN threads t ON t.id = p.thread_id
+        WHERE p.thread_id = $1
+        FOR UPDATE OF p`,
+		threadId,
+	).Scan(&pollId, &multiple, &closed, &locked)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Poll was not found!")
+	}
+	if locked {
+		return echo.NewHTTPError(http.StatusLocked, "Thread is locked")
+	}
+	if closed {
+		return echo.NewHTTPError(http.StatusLocked, "Poll is closed")
+	}
+
+	options := make(map[int]bool)
+	for _, optionId := range vote.Options {
+		options[optionId] = true
+	}
+	if len(options) == 0 || len(options) != len(vote.Options) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Options must be a non-empty list of distinct ids")
+	}
+	if !multiple && len(options) > 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Poll allows a single option")
+	}
+
+	var voted bool
+	err = tx.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM poll_votes WHERE poll_id = $1 AND user_id = $2)`,
+		pollId, userId,
+	).Scan(&voted)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if voted {
+		return echo.NewHTTPError(http.StatusConflict, "User has already voted")
+	}
+
+	for optionId := range options {
+		tag, err := tx.Exec(`
+            UPDATE poll_options SET votes = votes + 1 WHERE id = $1 AND poll_id = $2`,
+			optionId, pollId,
+		)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if tag.RowsAffected() == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Option does not belong to the poll")
+		}
+
+		_, err = tx.Exec(`
+            INSERT INTO poll_votes (poll_id, option_id, user_id) VALUES ($1, $2, $3)`,
+			pollId, optionId, userId,
+		)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	thr := models.Thread{}
+	err = db.QueryRow("thread_get_by_id", threadId).Scan(threadFields(&thr)...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	thr.Poll, err = threadPoll(db, threadId, vote.Nickname)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, thr)
+}
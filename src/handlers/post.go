@@ -3,9 +3,11 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/labstack/echo/v4"
@@ -24,13 +26,19 @@ func PostCreate(c echo.Context) error {
 	}
 
 	var forumSlug string
+	var locked bool
 	err = db.QueryRow(`
-        SELECT id, forum FROM threads WHERE slug = $1 OR id = $2`,
+        SELECT id, forum, locked FROM threads WHERE (slug = $1 OR id = $2) AND deleted_at IS NULL`,
 		threadSlug, threadId,
-	).Scan(&threadId, &forumSlug)
+	).Scan(&threadId, &forumSlug, &locked)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
 	}
+	if locked {
+		return echo.NewHTTPError(http.StatusLocked, "Thread is locked")
+	}
+	// only private forums need a membership check for every author
+	forumPublic := forumVisible(db, forumSlug, "")
 
 	posts := make([]models.Post, 0)
 	defer c.Request().Body.Close()
@@ -60,6 +68,7 @@ func PostCreate(c echo.Context) error {
 		}
 
 		var userIds []int
+		userPosts := make(map[int]int)
 		var queryValues string
 		var queryParams []interface{}
 		for i, post := range posts {
@@ -85,25 +94,29 @@ func PostCreate(c echo.Context) error {
 			if err != nil {
 				return echo.NewHTTPError(http.StatusNotFound, err.Error())
 			}
+			if !forumPublic && !forumVisible(db, forumSlug, post.Author) {
+				return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+			}
 
 			queryValues += fmt.Sprintf(
-				"($%d, $%d, $%d, $%d, $%d)",
-				i*5+1, i*5+2, i*5+3, i*5+4, i*5+5,
+				"($%d, $%d, $%d, $%d, $%d, $%d)",
+				i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6,
 			)
 			if i != len(posts)-1 {
 				queryValues += ", "
 			}
-			queryParams = append(queryParams, post.Author, post.Message, post.Thread, post.Forum, post.Parent)
+			queryParams = append(queryParams, post.Author, post.Message, utils.RenderMarkdown(post.Message), post.Thread, post.Forum, post.Parent)
 
 			if !utils.IntInList(authorId, userIds) {
 				userIds = append(userIds, authorId)
 			}
+			userPosts[authorId] += 1
 
 			newPosts = append(newPosts, post)
 		}
 
 		query := fmt.Sprintf(`
-            INSERT INTO posts (author, message, thread, forum, parent)
+            INSERT INTO posts (author, message, message_html, thread, forum, parent)
             VALUES %s
             RETURNING id, created`,
 			queryValues,
@@ -120,24 +133,49 @@ func PostCreate(c echo.Context) error {
 		}
 		rows.Close()
 
+		postIds := make([]int, 0, len(newPosts))
+		messages := make([]string, 0, len(newPosts))
+		for _, post := range newPosts {
+			postIds = append(postIds, post.Id)
+			messages = append(messages, post.Message)
+		}
+		err = utils.SaveMentions(tx, postIds, messages)
+		if err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		for i := range newPosts {
+			attached, err := postAttachFiles(tx, &newPosts[i])
+			if err != nil {
+				tx.Rollback()
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			if !attached {
+				tx.Rollback()
+				return echo.NewHTTPError(http.StatusConflict, "Attachment was not found or is already attached")
+			}
+		}
+
 		queryValues = ""
 		queryParams = nil
 		last := len(userIds) - 1
 		for i, userId := range userIds {
 			queryValues += fmt.Sprintf(
-				"($%d, $%d)",
-				i*2+1, i*2+2,
+				"($%d, $%d, $%d)",
+				i*3+1, i*3+2, i*3+3,
 			)
 			if i != last {
 				queryValues += ", "
 			}
-			queryParams = append(queryParams, forumId, userId)
+			queryParams = append(queryParams, forumId, userId, userPosts[userId])
 		}
 
 		query = fmt.Sprintf(`
-            INSERT INTO forum_users (forum_id, user_id)
+            INSERT INTO forum_users (forum_id, user_id, posts)
             VALUES %s
-            ON CONFLICT DO NOTHING`,
+            ON CONFLICT (forum_id, user_id) DO UPDATE SET
+                posts = forum_users.posts + EXCLUDED.posts,
+                last_active = NOW()`,
 			queryValues,
 		)
 		_, err = tx.Exec(query, queryParams...)
@@ -145,11 +183,31 @@ func PostCreate(c echo.Context) error {
 			tx.Rollback()
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		lastPost := newPosts[len(newPosts)-1]
+		_, err = tx.Exec(`
+            UPDATE threads SET posts = posts + $2, last_post_at = $3, last_post_author = $4
+            WHERE id = $1`,
+			threadId, newPostsAmount, lastPost.Created, lastPost.Author,
+		)
+		if err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 		_, err = tx.Exec("UPDATE status SET posts = posts + $1", newPostsAmount)
 		if err != nil {
 			tx.Rollback()
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		_, err = tx.Exec("forum_stats_add", forumId, 0, newPostsAmount, 0)
+		if err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		_, err = tx.Exec("forum_stats_authors_add", forumId, userIds)
+		if err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 		tx.Commit()
 	}
 
@@ -159,11 +217,25 @@ func PostCreate(c echo.Context) error {
 func PostList(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+
 	sort := c.QueryParam("sort")
 	if len(sort) == 0 {
 		sort = "flat"
 	}
 
+	nested, err := postListNested(c, sort)
+	if err != nil {
+		return err
+	}
+	// nested output pages whole trees, so tree is listed as parent_tree
+	if nested && sort == "tree" {
+		sort = "parent_tree"
+	}
+
 	limit, err := strconv.Atoi(c.QueryParam("limit"))
 	if err != nil {
 		limit = 100
@@ -173,23 +245,31 @@ func PostList(c echo.Context) error {
 	if err != nil {
 		desc = false
 	}
+	if desc && sort == "top" {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort top is always best first and can not be desc")
+	}
 
 	since, err := strconv.Atoi(c.QueryParam("since"))
 	if err != nil || since == 0 {
 		since = 0
 	}
-
-	var forumSlug string
-	threadSlug := c.Param("slug_or_id")
-	threadId, err := strconv.Atoi(threadSlug)
-	if err == nil {
-		err = db.QueryRow("thread_get_forum_by_id", threadId).Scan(&forumSlug)
-	} else {
-		err = db.QueryRow("thread_get_id_forum_by_slug", threadSlug).Scan(&threadId, &forumSlug)
+	var cursor utils.Cursor
+	if len(c.QueryParam("cursor")) > 0 {
+		cursor, err = utils.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil || cursor.Id == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		since = cursor.Id
 	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
+	if !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	threadCountView(c, threadId)
 
 	hasSince := since > 0
 	var rows *pgx.Rows
@@ -198,7 +278,9 @@ func PostList(c echo.Context) error {
 		orderStr = "desc"
 	}
 	queryStr := "post_list_" + orderStr + "_" + sort
-	if hasSince {
+	if sort == "top" && cursor.Score != nil {
+		rows, err = db.Query(queryStr+"_cursor", threadId, limit, *cursor.Score, cursor.Id)
+	} else if hasSince {
 		rows, err = db.Query(queryStr+"_since", threadId, limit, since)
 	} else {
 		rows, err = db.Query(queryStr, threadId, limit)
@@ -208,16 +290,46 @@ func PostList(c echo.Context) error {
 	}
 	defer rows.Close()
 
+	if nested {
+		return postsStreamTrees(c, db, rows, markup, limit, sort == "top")
+	}
+
 	posts := make([]models.Post, 0)
+	pageSize := 0
+	var lastRoot models.Post
 	for rows.Next() {
 		post := models.Post{Forum: forumSlug}
-		err := rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent)
+		err := rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent, &post.IsDeleted, &post.Score)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		// parent_tree and top limit the number of root posts, not of rows
+		if (sort != "parent_tree" && sort != "top") || post.Parent == 0 {
+			pageSize++
+		}
+		if post.Parent == 0 {
+			lastRoot = post
+		}
 		posts = append(posts, post)
 	}
 
+	if limit > 0 && pageSize == limit {
+		next := utils.Cursor{Id: posts[len(posts)-1].Id}
+		if sort == "top" {
+			next = utils.Cursor{Id: lastRoot.Id, Score: &lastRoot.Score}
+		}
+		c.Response().Header().Set(utils.CursorHeader, utils.EncodeCursor(next))
+	}
+
+	err = postsApplyMarkup(db, posts, markup)
+	if err == nil {
+		err = postsLoadAttachments(db, posts)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
 	return c.JSON(http.StatusOK, posts)
 }
 
@@ -235,11 +347,30 @@ func PostDetails(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	err = db.QueryRow("post_get_by_id", post.Id).Scan(&post.Parent, &post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited)
+	err = db.QueryRow("post_get_by_id", post.Id).Scan(&post.Parent, &post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited, &post.IsDeleted, &post.Score)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
-	details["post"] = post
+	var threadForum string
+	var deleted *time.Time
+	err = db.QueryRow("thread_get_forum_by_id", post.Thread).Scan(&threadForum, &deleted)
+	if err != nil || !threadVisible(db, threadForum, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+	posts := []models.Post{post}
+	err = postsApplyMarkup(db, posts, markup)
+	if err == nil {
+		err = postsLoadAttachments(db, posts)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	details["post"] = posts[0]
 
 	if utils.StringInList("user", related) {
 		author := models.User{}
@@ -253,16 +384,21 @@ func PostDetails(c echo.Context) error {
 	if utils.StringInList("thread", related) {
 		thread := models.Thread{Id: post.Thread}
 
-		err = db.QueryRow("thread_get_by_id", thread.Id).Scan(&thread.Author, &thread.Created, &thread.Forum, &thread.Message, &thread.Slug, &thread.Title, &thread.Votes)
+		err = db.QueryRow("thread_get_by_id", thread.Id).Scan(threadFields(&thread)...)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusNotFound, err.Error())
 		}
+		err = threadApplyMarkup(db, &thread, markup)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 		details["thread"] = thread
 	}
 
 	if utils.StringInList("forum", related) {
 		forum := models.Forum{}
-		err = db.QueryRow("forum_get_by_slug", post.Forum).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts)
+		err = db.QueryRow("forum_get_by_slug", post.Forum).Scan(&forum.Slug, &forum.Title, &forum.User, &forum.Threads, &forum.Posts, &forum.Private)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusNotFound, err.Error())
 		}
@@ -272,6 +408,148 @@ func PostDetails(c echo.Context) error {
 	return c.JSON(http.StatusOK, details)
 }
 
+// PostReplies lists the replies to a post with their replies in tree order.
+// ?depth limits how many levels below the post are returned, 0 means all of them.
+func PostReplies(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+
+	depth := 0
+	if len(c.QueryParam("depth")) > 0 {
+		depth, err = strconv.Atoi(c.QueryParam("depth"))
+		if err != nil || depth < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "depth must be a non-negative number")
+		}
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = 100
+	}
+
+	since, err := strconv.Atoi(c.QueryParam("since"))
+	if err != nil {
+		since = 0
+	}
+	if len(c.QueryParam("cursor")) > 0 {
+		cursor, err := utils.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil || cursor.Id == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		since = cursor.Id
+	}
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+
+	var path []int32
+	err = db.QueryRow(`SELECT path FROM posts WHERE id = $1`, postId).Scan(&path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	maxLength := 0
+	if depth > 0 {
+		maxLength = len(path) + depth
+	}
+
+	var rows *pgx.Rows
+	if since > 0 {
+		rows, err = db.Query("post_replies_since", path, limit, maxLength, since)
+	} else {
+		rows, err = db.Query("post_replies", path, limit, maxLength)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	posts, err := postsScan(rows)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if limit > 0 && len(posts) == limit {
+		c.Response().Header().Set(utils.CursorHeader, utils.EncodeCursor(utils.Cursor{Id: posts[len(posts)-1].Id}))
+	}
+
+	err = postsApplyMarkup(db, posts, markup)
+	if err == nil {
+		err = postsLoadAttachments(db, posts)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, posts)
+}
+
+// PostContext lists the posts a post replies to, from the root post of its tree down to its parent
+func PostContext(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+
+	rows, err := db.Query("post_context", postId)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	posts, err := postsScan(rows)
+	if err == nil {
+		err = postsApplyMarkup(db, posts, markup)
+	}
+	if err == nil {
+		err = postsLoadAttachments(db, posts)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, posts)
+}
+
+// postsScan reads the rows of the post listing statements and closes them
+func postsScan(rows *pgx.Rows) ([]models.Post, error) {
+	defer rows.Close()
+
+	posts := make([]models.Post, 0)
+	for rows.Next() {
+		post := models.Post{}
+		err := rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent, &post.IsDeleted, &post.Score)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
 func PostUpdate(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 	post := models.Post{}
@@ -289,17 +567,310 @@ func PostUpdate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	err = db.QueryRow(`
+	editor, err := revisionEditor(db, postUpd.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var oldMessage string
+	err = tx.QueryRow(`SELECT message FROM posts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, post.Id).Scan(&oldMessage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if postUpd.Message != nil && *postUpd.Message != oldMessage {
+		err = postSaveRevision(tx, post.Id, editor, oldMessage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	var messageHtml *string
+	if postUpd.Message != nil {
+		rendered := utils.RenderMarkdown(*postUpd.Message)
+		messageHtml = &rendered
+	}
+	err = tx.QueryRow(`
         UPDATE posts SET
             message = COALESCE($2, message),
-            is_edited = CASE WHEN $2 IS NOT NULL AND message != $2 THEN true ELSE false END
+            message_html = COALESCE($3, message_html),
+            is_edited = is_edited OR ($2 IS NOT NULL AND message != $2)
         WHERE id = $1
-        RETURNING author, created, forum, id, message, thread, is_edited`,
-		post.Id, postUpd.Message,
-	).Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited)
+        RETURNING author, created, forum, id, message, thread, is_edited, score`,
+		post.Id, postUpd.Message, messageHtml,
+	).Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited, &post.Score)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
+	if post.Message != oldMessage {
+		err = utils.SaveMentions(tx, []int{post.Id}, []string{post.Message})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, post)
+}
+
+// PostDelete deletes a post of ?nickname, its author or a forum moderator.
+// A post with replies becomes a tombstone with an empty message so the reply tree keeps its shape,
+// a leaf is removed together with the tombstones above it that are left without replies.
+// With ?subtree=true a moderator removes the post with all its replies.
+func PostDelete(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	nickname := c.QueryParam("nickname")
+	subtree, _ := strconv.ParseBool(c.QueryParam("subtree"))
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	moderator := forumModerator(db, forumSlug, nickname)
+	if subtree && !moderator {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can remove reply trees")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	post := models.Post{}
+	var path []int32
+	err = tx.QueryRow(`
+        SELECT author, thread, parent, path, deleted_at IS NOT NULL FROM posts
+        WHERE id = $1
+        FOR UPDATE`,
+		postId,
+	).Scan(&post.Author, &post.Thread, &post.Parent, &path, &post.IsDeleted)
+	if err != nil || (post.IsDeleted && !subtree) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	if !moderator && !strings.EqualFold(post.Author, nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the author or a moderator can delete the post")
+	}
+
+	// live posts removed per author, to take them out of the counters
+	removed := make(map[string]int)
+	var removeIds []int
+	tombstone := false
+	if subtree {
+		rows, err := tx.Query(`
+            SELECT id, author, deleted_at IS NULL FROM posts
+            WHERE thread = $1 AND path[1:$2] = $3::int[]`,
+			post.Thread, len(path), path,
+		)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		for rows.Next() {
+			var id int
+			var author string
+			var live bool
+			rows.Scan(&id, &author, &live)
+			removeIds = append(removeIds, id)
+			if live {
+				removed[author]++
+			}
+		}
+		rows.Close()
+	} else {
+		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM posts WHERE parent = $1)`, postId).Scan(&tombstone)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if !tombstone {
+			removeIds = append(removeIds, postId)
+		}
+		removed[post.Author]++
+	}
+
+	if tombstone {
+		_, err = tx.Exec(`UPDATE posts SET message = '', message_html = '', deleted_at = NOW() WHERE id = $1`, postId)
+		if err == nil {
+			err = utils.SaveMentions(tx, []int{postId}, []string{""})
+		}
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM attachments WHERE post_id = $1`, postId)
+		}
+		// the history would give the deleted text back
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM post_revisions WHERE post_id = $1`, postId)
+		}
+	} else {
+		err = utils.DeletePosts(tx, removeIds)
+	}
+
+	// climb up removing tombstones that lost their last reply
+	for parentId := post.Parent; err == nil && !tombstone && parentId != 0; {
+		var nextId int
+		err = tx.QueryRow(`
+            SELECT parent FROM posts p
+            WHERE id = $1 AND deleted_at IS NOT NULL AND NOT EXISTS(SELECT 1 FROM posts WHERE parent = p.id)`,
+			parentId,
+		).Scan(&nextId)
+		if err == pgx.ErrNoRows {
+			err = nil
+			break
+		}
+		if err == nil {
+			err = utils.DeletePosts(tx, []int{parentId})
+		}
+		parentId = nextId
+	}
+
+	removedTotal := 0
+	for author, n := range removed {
+		removedTotal += n
+		if err == nil {
+			_, err = tx.Exec(`
+                UPDATE forum_users SET posts = posts - $3
+                WHERE forum_id = (SELECT id FROM forums WHERE slug = $1)
+                    AND user_id = (SELECT id FROM users WHERE nickname = $2)`,
+				forumSlug, author, n,
+			)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE forums SET posts = posts - $2 WHERE slug = $1`, forumSlug, removedTotal)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE status SET posts = posts - $1`, removedTotal)
+	}
+	if err == nil {
+		_, err = tx.Exec(threadRefreshActivity, []int{post.Thread})
+	}
+	if err == nil && tombstone {
+		err = tx.QueryRow("post_get_by_id", postId).Scan(&post.Parent, &post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited, &post.IsDeleted, &post.Score)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if tombstone {
+		return c.JSON(http.StatusOK, post)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PostVote sets the vote of a user on a post; voice 0 retracts it
+func PostVote(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	vote := models.PostVote{}
+	defer c.Request().Body.Close()
+	err = json.NewDecoder(c.Request().Body).Decode(&vote)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if vote.Voice > 1 || vote.Voice < -1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "abs(voice) > 1")
+	}
+
+	var userId int
+	err = db.QueryRow(`
+        SELECT id, nickname FROM users WHERE nickname = $1`,
+		vote.Nickname,
+	).Scan(&userId, &vote.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, vote.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	// the post row lock serializes votes on the post
+	var locked, tombstone bool
+	err = tx.QueryRow(`
+        SELECT t.locked, p.deleted_at IS NOT NULL
+        FROM posts p
+            INNER JOIN threads t ON t.id = p.thread
+        WHERE p.id = $1
+        FOR UPDATE OF p`,
+		postId,
+	).Scan(&locked, &tombstone)
+	if err != nil || tombstone {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	if locked {
+		return echo.NewHTTPError(http.StatusLocked, "Thread is locked")
+	}
+
+	prevVoice := 0
+	err = tx.QueryRow("post_vote_get", postId, userId).Scan(&prevVoice)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	err = nil
+	switch {
+	case prevVoice == vote.Voice:
+	case vote.Voice == 0:
+		_, err = tx.Exec(`DELETE FROM post_votes WHERE post_id = $1 AND user_id = $2`, postId, userId)
+	case prevVoice == 0:
+		_, err = tx.Exec(`
+            INSERT INTO post_votes (post_id, user_id, voice) VALUES ($1, $2, $3)`,
+			postId, userId, vote.Voice,
+		)
+	default:
+		_, err = tx.Exec(`
+            UPDATE post_votes SET voice = $3 WHERE post_id = $1 AND user_id = $2`,
+			postId, userId, vote.Voice,
+		)
+	}
+
+	post := models.Post{}
+	if err == nil {
+		err = tx.QueryRow(`
+            UPDATE posts SET score = score + $2
+            WHERE id = $1
+            RETURNING parent, author, created, forum, id, message, thread, is_edited, deleted_at IS NOT NULL, score`,
+			postId, vote.Voice-prevVoice,
+		).Scan(&post.Parent, &post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.IsEdited, &post.IsDeleted, &post.Score)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	return c.JSON(http.StatusOK, post)
 }
@@ -13,6 +13,7 @@ import (
 func ServiceClear(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 
+	utils.ThreadViews.Reset()
 	err := utils.ClearDB(db)
 	if err != nil {
 		log.Println(err)
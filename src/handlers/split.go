@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/statements"
+	"tp_db_homework/src/utils"
+)
+
+// threadRefreshActivity recounts posts and the last post of threads $1 after posts moved between them
+const threadRefreshActivity = `
+    UPDATE threads t SET
+        posts = (SELECT COUNT(*) FROM posts WHERE thread = t.id AND deleted_at IS NULL),
+        last_post_at = (SELECT MAX(created) FROM posts WHERE thread = t.id AND deleted_at IS NULL),
+        last_post_author = (
+            SELECT author FROM posts WHERE thread = t.id AND deleted_at IS NULL ORDER BY created DESC, id DESC LIMIT 1
+        )
+    WHERE id = ANY($1::int[])`
+
+// PostSplit moves a post with all its descendants into a new thread of the same forum
+func PostSplit(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	postId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	split := models.PostSplit{}
+	defer c.Request().Body.Close()
+	err = json.NewDecoder(c.Request().Body).Decode(&split)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	split.Title = strings.TrimSpace(split.Title)
+	if len(split.Title) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Title is empty")
+	}
+	if utils.IsNumericSlug(split.Slug) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Slug can not be a number")
+	}
+	if utils.IsReservedSlug(split.Slug) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Slug is reserved")
+	}
+
+	forumSlug, deleted, err := postGetThread(db, postId)
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, split.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	if !forumModerator(db, forumSlug, split.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can split threads")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var sourceId int
+	var author, message string
+	var created time.Time
+	var path []int32
+	err = tx.QueryRow(`
+        SELECT t.id, p.author, p.message, p.created, p.path
+        FROM posts p
+            INNER JOIN threads t ON t.id = p.thread
+        WHERE p.id = $1 AND t.deleted_at IS NULL
+        FOR UPDATE OF t`,
+		postId,
+	).Scan(&sourceId, &author, &message, &created, &path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Post was not found!")
+	}
+	if split.Message != nil {
+		message = *split.Message
+	}
+
+	if len(split.Slug) > 0 {
+		var count int
+		err = tx.QueryRow(`
+            SELECT
+                (SELECT COUNT(*) FROM threads WHERE slug = $1) +
+                (SELECT COUNT(*) FROM thread_slug_aliases WHERE slug = $1)`,
+			split.Slug,
+		).Scan(&count)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if count > 0 {
+			return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+		}
+	} else {
+		split.Slug, err = threadGenerateSlug(tx, split.Title)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	var threadId int
+	err = tx.QueryRow(`
+        INSERT INTO threads (forum, title, author, message, message_html, created, slug) VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id`,
+		forumSlug, split.Title, author, message, utils.RenderMarkdown(message), created, split.Slug,
+	).Scan(&threadId)
+	if utils.IsUniqueViolation(err) {
+		return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// the post becomes a top level one: its path loses everything above it
+	_, err = tx.Exec(`
+        UPDATE posts SET
+            thread = $2,
+            parent = CASE WHEN id = $1 THEN 0 ELSE parent END,
+            path = ARRAY[0] || path[$4:array_length(path, 1)]
+        WHERE thread = $3 AND path[1:$4] = $5::int[]`,
+		postId, threadId, sourceId, len(path), path,
+	)
+	if err == nil {
+		_, err = tx.Exec(threadRefreshActivity, []int{sourceId, threadId})
+	}
+
+	var forumId int
+	if err == nil {
+		err = tx.QueryRow(`
+            UPDATE forums SET threads = threads + 1 WHERE slug = $1
+            RETURNING id`,
+			forumSlug,
+		).Scan(&forumId)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            INSERT INTO forum_users (forum_id, user_id, posts, threads)
+            SELECT $1, id, 0, 1 FROM users WHERE nickname = $2
+            ON CONFLICT (forum_id, user_id) DO UPDATE SET threads = forum_users.threads + 1`,
+			forumId, author,
+		)
+	}
+	// daily stats count new content only, a split makes none
+	if err == nil {
+		_, err = tx.Exec(`UPDATE status SET threads = threads + 1`)
+	}
+
+	thr := models.Thread{}
+	if err == nil {
+		err = tx.QueryRow("thread_get_by_id", threadId).Scan(threadFields(&thr)...)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, thr)
+}
+
+// ThreadMerge moves all posts of a thread into another thread of the same forum and deletes it.
+// The opening message of the merged thread becomes a post under the chosen parent and its former
+// top level posts become replies to it. The slug of the merged thread keeps working as an alias.
+func ThreadMerge(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	merge := models.ThreadMerge{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&merge)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	sourceId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, merge.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, merge.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can merge threads")
+	}
+
+	targetId, targetForum, deleted, err := threadGetIdForum(db, merge.Target)
+	if err != nil || deleted != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Target thread was not found!")
+	}
+	if targetId == sourceId {
+		return echo.NewHTTPError(http.StatusConflict, "Thread can not be merged into itself")
+	}
+	if targetForum != forumSlug {
+		return echo.NewHTTPError(http.StatusConflict, "Threads are in different forums")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var locked int
+	err = tx.QueryRow(`
+        SELECT COUNT(*) FROM (
+            SELECT id FROM threads WHERE id IN ($1, $2) AND deleted_at IS NULL ORDER BY id FOR UPDATE
+        ) t`,
+		sourceId, targetId,
+	).Scan(&locked)
+	if err != nil || locked != 2 {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	if merge.Parent != 0 {
+		var parentThread int
+		err = tx.QueryRow(`SELECT thread FROM posts WHERE id = $1`, merge.Parent).Scan(&parentThread)
+		if err != nil || parentThread != targetId {
+			return echo.NewHTTPError(http.StatusConflict, "Parent post was not found in the target thread")
+		}
+	}
+
+	var author, message, slug string
+	var created time.Time
+	err = tx.QueryRow(`
+        SELECT author, message, created, slug FROM threads WHERE id = $1`,
+		sourceId,
+	).Scan(&author, &message, &created, &slug)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	var openingId int
+	var openingPath []int32
+	err = tx.QueryRow(`
+        INSERT INTO posts (parent, author, message, message_html, forum, thread, created) VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, path`,
+		merge.Parent, author, message, utils.RenderMarkdown(message), forumSlug, targetId, created,
+	).Scan(&openingId, &openingPath)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	err = utils.SaveMentions(tx, []int{openingId}, []string{message})
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	_, err = tx.Exec(`
+        UPDATE posts SET
+            thread = $2,
+            parent = CASE WHEN parent = 0 THEN $3 ELSE parent END,
+            path = $4::int[] || path[2:array_length(path, 1)]
+        WHERE thread = $1`,
+		sourceId, targetId, openingId, openingPath,
+	)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE thread_slug_aliases SET thread_id = $2 WHERE thread_id = $1`, sourceId, targetId)
+	}
+	if err == nil {
+		err = utils.DeleteThread(tx, sourceId)
+	}
+	if err == nil && len(slug) > 0 {
+		_, err = tx.Exec(`
+            INSERT INTO thread_slug_aliases (slug, thread_id) VALUES ($1, $2)
+            ON CONFLICT (slug) DO UPDATE SET thread_id = EXCLUDED.thread_id`,
+			slug, targetId,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(threadRefreshActivity, []int{targetId})
+	}
+
+	// the thread turned into a post
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE forums SET threads = threads - 1, posts = posts + 1 WHERE slug = $1`,
+			forumSlug,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE forum_users SET posts = posts + 1, threads = threads - 1
+            WHERE forum_id = (SELECT id FROM forums WHERE slug = $1)
+                AND user_id = (SELECT id FROM users WHERE nickname = $2)`,
+			forumSlug, author,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE status SET threads = threads - 1, posts = posts + 1`)
+	}
+
+	thr := models.Thread{}
+	if err == nil {
+		err = tx.QueryRow(fmt.Sprintf(`
+            SELECT %s FROM threads WHERE id = $1`,
+			statements.ThreadColumns),
+			targetId,
+		).Scan(threadFields(&thr)...)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, thr)
+}
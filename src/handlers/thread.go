@@ -2,18 +2,61 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/labstack/echo/v4"
 
 	"tp_db_homework/src/models"
+	"tp_db_homework/src/statements"
 	"tp_db_homework/src/utils"
 )
 
+// threadGetIdForum resolves a slug_or_id route parameter
+func threadGetIdForum(db *pgx.ConnPool, slugOrId string) (int, string, *time.Time, error) {
+	var forumSlug string
+	var deleted *time.Time
+	threadId, err := strconv.Atoi(slugOrId)
+	if err == nil {
+		err = db.QueryRow("thread_get_forum_by_id", threadId).Scan(&forumSlug, &deleted)
+	} else {
+		err = db.QueryRow("thread_get_id_forum_by_slug", slugOrId).Scan(&threadId, &forumSlug, &deleted)
+	}
+	return threadId, forumSlug, deleted, err
+}
+
+// threadVisible hides soft-deleted threads from everyone except forum moderators
+func threadVisible(db *pgx.ConnPool, forumSlug string, deleted *time.Time, nickname string) bool {
+	if !forumVisible(db, forumSlug, nickname) {
+		return false
+	}
+	return deleted == nil || forumModerator(db, forumSlug, nickname)
+}
+
+// threadFields lists scan targets in the order of statements.ThreadColumns
+func threadFields(thr *models.Thread) []interface{} {
+	return []interface{}{
+		&thr.Author, &thr.Created, &thr.Forum, &thr.Id, &thr.Message, &thr.Slug, &thr.Title, &thr.Votes, &thr.Deleted,
+		&thr.Pinned, &thr.Locked, &thr.Announcement, &thr.Tags,
+		&thr.Posts, &thr.LastPostAt, &thr.LastPostAuthor, &thr.Upvotes, &thr.Downvotes,
+		&thr.Views,
+	}
+}
+
+// threadCountView counts a read of the thread by the ?nickname viewer or, for anonymous ones, by IP
+func threadCountView(c echo.Context, threadId int) {
+	viewer := c.QueryParam("nickname")
+	if len(viewer) == 0 {
+		viewer = "ip:" + c.RealIP()
+	}
+	utils.ThreadViews.Hit(threadId, strings.ToLower(viewer))
+}
+
 func ThreadCreate(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 
@@ -25,6 +68,19 @@ func ThreadCreate(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	newThread.Tags = utils.NormalizeTags(newThread.Tags)
+	if newThread.Poll != nil {
+		err = pollValidate(newThread.Poll)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if utils.IsNumericSlug(newThread.Slug) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Slug can not be a number")
+	}
+	if utils.IsReservedSlug(newThread.Slug) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Slug is reserved")
+	}
 
 	var authorId int
 	err = db.QueryRow(`
@@ -34,20 +90,35 @@ func ThreadCreate(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
 	}
+	if !forumVisible(db, newThread.Forum, newThread.Author) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found!")
+	}
 
 	if len(newThread.Slug) > 0 {
 		var oldThread models.Thread
+		var deleted *time.Time
 		err = db.QueryRow(`
-            SELECT id, author, created, forum, message, slug, title FROM threads WHERE slug = $1`,
+            SELECT id, author, created, forum, message, slug, title, deleted_at FROM threads
+            WHERE slug = $1 OR id = (SELECT thread_id FROM thread_slug_aliases WHERE slug = $1)`,
 			newThread.Slug,
-		).Scan(&oldThread.Id, &oldThread.Author, &oldThread.Created, &oldThread.Forum, &oldThread.Message, &oldThread.Slug, &oldThread.Title)
+		).Scan(&oldThread.Id, &oldThread.Author, &oldThread.Created, &oldThread.Forum, &oldThread.Message, &oldThread.Slug, &oldThread.Title, &deleted)
 		if err == nil {
+			// the taken thread is only shown to those who may read it
+			if !threadVisible(db, oldThread.Forum, deleted, newThread.Author) {
+				return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+			}
 			return echo.NewHTTPError(http.StatusConflict, oldThread)
 		}
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
 	var forumId int
-	err = db.QueryRow(`
+	err = tx.QueryRow(`
         UPDATE forums SET threads = threads + 1 WHERE slug = $1
         RETURNING id, slug`,
 		newThread.Forum,
@@ -56,25 +127,92 @@ func ThreadCreate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found!")
 	}
 
-	err = db.QueryRow(`
-        INSERT INTO threads (forum, title, author, message, created, slug) VALUES ($1, $2, $3, $4, $5, $6)
+	if len(newThread.Slug) == 0 {
+		newThread.Slug, err = threadGenerateSlug(tx, newThread.Title)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	err = tx.QueryRow(`
+        INSERT INTO threads (forum, title, author, message, message_html, created, slug, tags)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8::text[]::citext[])
         RETURNING id`,
-		newThread.Forum, newThread.Title, newThread.Author, newThread.Message, newThread.Created, newThread.Slug,
+		newThread.Forum, newThread.Title, newThread.Author, newThread.Message, utils.RenderMarkdown(newThread.Message),
+		newThread.Created, newThread.Slug, newThread.Tags,
 	).Scan(&newThread.Id)
+	if utils.IsUniqueViolation(err) {
+		return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+	}
 	if err != nil {
 		log.Println(err)
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	db.Exec(`
-        INSERT INTO forum_users (forum_id, user_id) VALUES ($1, $2)`,
-		forumId, authorId,
-	)
-	_, err = db.Exec(`UPDATE status SET threads = threads + 1`)
+	if newThread.Poll != nil {
+		err = pollCreate(tx, newThread.Id, newThread.Poll)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	_, err = tx.Exec("forum_users_add", forumId, authorId, 0, 1)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE status SET threads = threads + 1`)
+	}
+	if err == nil {
+		_, err = tx.Exec("forum_stats_add", forumId, 1, 0, 0)
+	}
+	if err == nil {
+		_, err = tx.Exec("forum_stats_authors_add", forumId, []int{authorId})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	return c.JSON(http.StatusCreated, newThread)
 }
 
+// threadGenerateSlug makes a slug from the title that no thread uses, neither as a slug nor as an alias.
+// Creations of the same slug are serialized with an advisory lock held until tx ends.
+func threadGenerateSlug(tx *pgx.Tx, title string) (string, error) {
+	slug := utils.Slugify(title)
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, slug)
+	if err != nil {
+		return "", err
+	}
+
+	rows, err := tx.Query(`
+        SELECT slug::text FROM threads WHERE slug = $1 OR slug LIKE $2
+        UNION
+        SELECT slug::text FROM thread_slug_aliases WHERE slug = $1 OR slug LIKE $2`,
+		slug, slug+"-%",
+	)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return "", err
+		}
+		taken = append(taken, s)
+	}
+	if rows.Err() != nil {
+		return "", rows.Err()
+	}
+	return utils.UniqueSlug(slug, taken), nil
+}
+
 func ThreadList(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 
@@ -83,25 +221,58 @@ func ThreadList(c echo.Context) error {
 	desc, _ := strconv.ParseBool(c.QueryParam("desc"))
 
 	err := db.QueryRow("forum_get_slug_by_slug", forumSlug).Scan(&forumSlug)
-	if err != nil {
+	if err != nil || !forumVisible(db, forumSlug, c.QueryParam("nickname")) {
 		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found")
 	}
 
+	sort := c.QueryParam("sort")
+	if len(sort) == 0 {
+		sort = "created"
+	}
+	if !utils.StringInList(sort, []string{"created", "activity", "votes", "replies", "views"}) {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be created, activity, votes, replies or views")
+	}
+
 	hasSince := true
-	since, err := time.Parse(time.RFC3339, c.QueryParam("since"))
+	var since interface{}
+	var cursor *utils.Cursor
+	if len(c.QueryParam("cursor")) > 0 {
+		decoded, err := utils.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil || decoded.Id == 0 || (sort == "created" && decoded.Created == nil) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		cursor = &decoded
+		since = decoded.Id
+		if sort == "created" {
+			since = *decoded.Created
+		}
+	} else if sort == "created" {
+		since, err = time.Parse(time.RFC3339, c.QueryParam("since"))
+	} else {
+		since, err = strconv.Atoi(c.QueryParam("since"))
+	}
 	if err != nil {
 		hasSince = false
 	}
+	showDeleted := forumModerator(db, forumSlug, c.QueryParam("nickname"))
+
+	var tags []string
+	if len(c.QueryParam("tags")) > 0 {
+		tags = utils.NormalizeTags(strings.Split(c.QueryParam("tags"), ","))
+	}
+	allTags := c.QueryParam("tags_mode") == "all"
 
 	orderStr := "asc"
 	if desc {
 		orderStr = "desc"
 	}
 	var rows *pgx.Rows
-	if hasSince {
-		rows, err = db.Query("thread_list_"+orderStr+"_since", forumSlug, limit, since)
+	if cursor != nil && sort == "created" {
+		rows, err = db.Query("thread_list_created_"+orderStr+"_cursor", forumSlug, limit, since, showDeleted, tags, allTags, cursor.Id, cursor.Pinned)
+	} else if hasSince {
+		rows, err = db.Query("thread_list_"+sort+"_"+orderStr+"_since", forumSlug, limit, since, showDeleted, tags, allTags)
 	} else {
-		rows, err = db.Query("thread_list_"+orderStr, forumSlug, limit)
+		rows, err = db.Query("thread_list_"+sort+"_"+orderStr, forumSlug, limit, showDeleted, tags, allTags)
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -111,7 +282,7 @@ func ThreadList(c echo.Context) error {
 	threads := make([]models.Thread, 0)
 	for rows.Next() {
 		thr := models.Thread{}
-		err := rows.Scan(&thr.Author, &thr.Created, &thr.Forum, &thr.Id, &thr.Message, &thr.Slug, &thr.Title, &thr.Votes)
+		err := rows.Scan(threadFields(&thr)...)
 
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -119,10 +290,35 @@ func ThreadList(c echo.Context) error {
 		threads = append(threads, thr)
 	}
 
+	if limit > 0 && len(threads) == limit {
+		last := threads[len(threads)-1]
+		c.Response().Header().Set(utils.CursorHeader, utils.EncodeCursor(utils.Cursor{Created: &last.Created, Id: last.Id, Pinned: last.Pinned}))
+	}
+
 	return c.JSON(http.StatusOK, threads)
 }
 
 func ThreadVote(c echo.Context) error {
+	var thrVote models.ThreadVote
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&thrVote)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if thrVote.Voice > 1 || thrVote.Voice < -1 {
+		log.Println("abs(voice) > 1")
+		return echo.NewHTTPError(http.StatusBadRequest, "abs(voice) > 1")
+	}
+	return threadVote(c, thrVote)
+}
+
+// ThreadUnvote retracts the vote of ?nickname, the same as voting with voice 0
+func ThreadUnvote(c echo.Context) error {
+	return threadVote(c, models.ThreadVote{Nickname: c.QueryParam("nickname")})
+}
+
+func threadVote(c echo.Context, thrVote models.ThreadVote) error {
 	db := c.(*utils.ContextAndDb).DB
 
 	threadSlug := c.Param("slug_or_id")
@@ -132,26 +328,18 @@ func ThreadVote(c echo.Context) error {
 	}
 
 	thr := models.Thread{}
-	err = db.QueryRow(`
-        SELECT author, created, forum, id, message, slug, title, votes
+	err = db.QueryRow(fmt.Sprintf(`
+        SELECT %s
         FROM threads
-        WHERE slug = $1 OR id = $2`,
+        WHERE (slug = $1 OR id = $2) AND deleted_at IS NULL`,
+		statements.ThreadColumns),
 		threadSlug, threadId,
-	).Scan(&thr.Author, &thr.Created, &thr.Forum, &thr.Id, &thr.Message, &thr.Slug, &thr.Title, &thr.Votes)
+	).Scan(threadFields(&thr)...)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
-
-	var thrVote models.ThreadVote
-	defer c.Request().Body.Close()
-	err = json.NewDecoder(c.Request().Body).Decode(&thrVote)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-	}
-
-	if thrVote.Voice > 1 || thrVote.Voice < -1 {
-		log.Println("abs(voice) > 1")
-		return echo.NewHTTPError(http.StatusBadRequest, "abs(voice) > 1")
+	if thr.Locked {
+		return echo.NewHTTPError(http.StatusLocked, "Thread is locked")
 	}
 
 	var userId int
@@ -162,6 +350,9 @@ func ThreadVote(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
+	if !forumVisible(db, thr.Forum, thrVote.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -169,53 +360,142 @@ func ThreadVote(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var prevVoice int
-	err = db.QueryRow(`
-        SELECT voice FROM thread_votes WHERE thread_id = $1 AND user_id = $2 LIMIT 1`,
+	// the thread row lock serializes votes on the thread, so the previous voice can not change under us
+	_, err = tx.Exec(`SELECT id FROM threads WHERE id = $1 FOR UPDATE`, thr.Id)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	prevVoice := 0
+	err = tx.QueryRow(`
+        SELECT voice FROM thread_votes WHERE thread_id = $1 AND user_id = $2`,
 		thr.Id, userId,
 	).Scan(&prevVoice)
-	if err != nil {
-		prevVoice = 0
-		if thr.Id <= 0 || userId <= 0 {
-			log.Printf("No thread_votes for %d and %d", thr.Id, userId)
-		}
-		prevVoice = 0
-		_, err := tx.Exec(`
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if prevVoice == thrVote.Voice {
+		return c.JSON(http.StatusOK, thr)
+	}
+
+	switch {
+	case thrVote.Voice == 0:
+		_, err = tx.Exec(`
+            DELETE FROM thread_votes WHERE thread_id = $1 AND user_id = $2`,
+			thr.Id, userId,
+		)
+	case prevVoice == 0:
+		_, err = tx.Exec(`
             INSERT INTO thread_votes (thread_id, user_id, voice) VALUES ($1, $2, $3)`,
 			thr.Id, userId, thrVote.Voice,
 		)
-		if err != nil {
-			log.Println(err)
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-		}
-	} else if prevVoice != thrVote.Voice {
-		_, err := tx.Exec(`
+	default:
+		_, err = tx.Exec(`
             UPDATE thread_votes SET voice = $3 WHERE thread_id = $1 AND user_id = $2`,
 			thr.Id, userId, thrVote.Voice,
 		)
-		if err != nil {
-			log.Println(err)
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	countVoice := func(voice int, value int) int {
+		if voice == value {
+			return 1
 		}
+		return 0
+	}
+	err = tx.QueryRow(`
+        UPDATE threads SET
+            votes = votes + $2,
+            upvotes = upvotes + $3,
+            downvotes = downvotes + $4
+        WHERE id = $1
+        RETURNING votes, upvotes, downvotes`,
+		thr.Id, thrVote.Voice-prevVoice,
+		countVoice(thrVote.Voice, 1)-countVoice(prevVoice, 1),
+		countVoice(thrVote.Voice, -1)-countVoice(prevVoice, -1),
+	).Scan(&thr.Votes, &thr.Upvotes, &thr.Downvotes)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	if prevVoice != thrVote.Voice {
-		err = tx.QueryRow(`
-            UPDATE threads SET
-                votes = votes + $2
-            WHERE id = $1
-            RETURNING votes`,
-			thr.Id, thrVote.Voice-prevVoice,
-		).Scan(&thr.Votes)
-		if err != nil {
-			log.Println(err)
+	// a vote is counted on the day it is cast, changing or retracting it later does not count again
+	if prevVoice == 0 {
+		var forumId int
+		err = tx.QueryRow("forum_get_id_by_slug", thr.Forum).Scan(&forumId)
+		if err == nil {
+			_, err = tx.Exec("forum_stats_add", forumId, 0, 0, 1)
 		}
 	}
-	tx.Commit()
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	return c.JSON(http.StatusOK, thr)
 }
 
+func ThreadVotes(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = 100
+	}
+	voice, _ := strconv.Atoi(c.QueryParam("voice"))
+	if voice > 1 || voice < -1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "voice must be 1 or -1")
+	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	ledger := models.ThreadVotes{Votes: make([]models.ThreadVote, 0)}
+	err = db.QueryRow(`
+        SELECT upvotes, downvotes FROM threads WHERE id = $1`,
+		threadId,
+	).Scan(&ledger.Upvotes, &ledger.Downvotes)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	rows, err := db.Query(`
+        SELECT v.id, u.nickname, v.voice
+        FROM thread_votes v
+            INNER JOIN users u ON u.id = v.user_id
+        WHERE v.thread_id = $1 AND ($3 = 0 OR v.voice = $3)
+        ORDER BY v.id
+        LIMIT $2`,
+		threadId, limit, voice,
+	)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		vote := models.ThreadVote{Thread: threadId}
+		err = rows.Scan(&vote.Id, &vote.Nickname, &vote.Voice)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		ledger.Votes = append(ledger.Votes, vote)
+	}
+
+	return c.JSON(http.StatusOK, ledger)
+}
+
 func ThreadDetails(c echo.Context) error {
 	db := c.(*utils.ContextAndDb).DB
 
@@ -224,13 +504,31 @@ func ThreadDetails(c echo.Context) error {
 	thr.Slug = c.Param("slug_or_id")
 	thr.Id, err = strconv.Atoi(thr.Slug)
 	if err == nil {
-		err = db.QueryRow("thread_get_by_id", thr.Id).Scan(&thr.Author, &thr.Created, &thr.Forum, &thr.Message, &thr.Slug, &thr.Title, &thr.Votes)
+		err = db.QueryRow("thread_get_by_id", thr.Id).Scan(threadFields(&thr)...)
 	} else {
-		err = db.QueryRow("thread_get_by_slug", thr.Slug).Scan(&thr.Author, &thr.Created, &thr.Forum, &thr.Id, &thr.Message, &thr.Slug, &thr.Title, &thr.Votes)
+		err = db.QueryRow("thread_get_by_slug", thr.Slug).Scan(threadFields(&thr)...)
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
+	if !threadVisible(db, thr.Forum, thr.Deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	thr.Poll, err = threadPoll(db, thr.Id, c.QueryParam("nickname"))
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+	err = threadApplyMarkup(db, &thr, markup)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	threadCountView(c, thr.Id)
 
 	return c.JSON(http.StatusOK, thr)
 }
@@ -251,15 +549,539 @@ func ThreadUpdate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	var tags []string
+	if thrUpd.Tags != nil {
+		tags = utils.NormalizeTags(*thrUpd.Tags)
+	}
+	editor, err := revisionEditor(db, thrUpd.Nickname)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var oldTitle, oldMessage string
+	err = tx.QueryRow(`
+        SELECT id, title, message FROM threads
+        WHERE (slug = $1 OR id = $2) AND deleted_at IS NULL
+        FOR UPDATE`,
+		threadSlug, threadId,
+	).Scan(&threadId, &oldTitle, &oldMessage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if (thrUpd.Title != nil && *thrUpd.Title != oldTitle) || (thrUpd.Message != nil && *thrUpd.Message != oldMessage) {
+		err = threadSaveRevision(tx, threadId, editor, oldTitle, oldMessage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	var messageHtml *string
+	if thrUpd.Message != nil {
+		rendered := utils.RenderMarkdown(*thrUpd.Message)
+		messageHtml = &rendered
+	}
 	thr := models.Thread{}
-	err = db.QueryRow(`
-        UPDATE threads SET title = COALESCE($3, title), message = COALESCE($4, message)
-        WHERE slug = $1 OR id = $2
-        RETURNING author, created, forum, id, message, slug, title, votes`,
-		threadSlug, threadId, thrUpd.Title, thrUpd.Message,
-	).Scan(&thr.Author, &thr.Created, &thr.Forum, &thr.Id, &thr.Message, &thr.Slug, &thr.Title, &thr.Votes)
+	err = tx.QueryRow(fmt.Sprintf(`
+        UPDATE threads SET
+            title = COALESCE($2, title),
+            message = COALESCE($3, message),
+            message_html = COALESCE($4, message_html),
+            tags = COALESCE($5::text[]::citext[], tags)
+        WHERE id = $1
+        RETURNING %s`,
+		statements.ThreadColumns),
+		threadId, thrUpd.Title, thrUpd.Message, messageHtml, tags,
+	).Scan(threadFields(&thr)...)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
 	return c.JSON(http.StatusOK, thr)
 }
+
+func ThreadRename(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	rename := models.SlugRename{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&rename)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(rename.Slug) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "New slug is empty")
+	}
+	if utils.IsNumericSlug(rename.Slug) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Slug can not be a number")
+	}
+	if utils.IsReservedSlug(rename.Slug) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Slug is reserved")
+	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || deleted != nil || !forumVisible(db, forumSlug, rename.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, rename.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can rename threads")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var oldSlug string
+	err = tx.QueryRow(`
+        SELECT slug FROM threads WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		threadId,
+	).Scan(&oldSlug)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+
+	var count int
+	err = tx.QueryRow(`
+        SELECT
+            (SELECT COUNT(*) FROM threads WHERE slug = $1 AND id != $2) +
+            (SELECT COUNT(*) FROM thread_slug_aliases WHERE slug = $1 AND thread_id != $2)`,
+		rename.Slug, threadId,
+	).Scan(&count)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+	}
+
+	_, err = tx.Exec(`DELETE FROM thread_slug_aliases WHERE slug = $1`, rename.Slug)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	thr := models.Thread{}
+	err = tx.QueryRow(fmt.Sprintf(`
+        UPDATE threads SET slug = $2 WHERE id = $1
+        RETURNING %s`,
+		statements.ThreadColumns),
+		threadId, rename.Slug,
+	).Scan(threadFields(&thr)...)
+	if utils.IsUniqueViolation(err) {
+		return echo.NewHTTPError(http.StatusConflict, "Slug is already taken")
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if len(oldSlug) > 0 && !strings.EqualFold(oldSlug, thr.Slug) {
+		_, err = tx.Exec(`
+            INSERT INTO thread_slug_aliases (slug, thread_id) VALUES ($1, $2)
+            ON CONFLICT (slug) DO UPDATE SET thread_id = EXCLUDED.thread_id`,
+			oldSlug, threadId,
+		)
+		if err != nil {
+			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, thr)
+}
+
+func ThreadDelete(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can delete threads")
+	}
+
+	thr, err := threadSetDeleted(db, threadId, true)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, thr)
+}
+
+// ThreadRestore brings back a deleted thread, the moderator is ?nickname as for ThreadDelete
+func ThreadRestore(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || !threadVisible(db, forumSlug, deleted, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can restore threads")
+	}
+
+	thr, err := threadSetDeleted(db, threadId, false)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, thr)
+}
+
+// threadSetDeleted soft-deletes or restores a thread, taking its posts in or out of the counters
+func threadSetDeleted(db *pgx.ConnPool, threadId int, delete bool) (models.Thread, error) {
+	thr := models.Thread{}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return thr, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var deleted *time.Time
+	err = tx.QueryRow(`
+        SELECT deleted_at FROM threads WHERE id = $1 FOR UPDATE`,
+		threadId,
+	).Scan(&deleted)
+	if err != nil {
+		return thr, echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if delete && deleted != nil {
+		return thr, echo.NewHTTPError(http.StatusConflict, "Thread is already deleted")
+	}
+	if !delete && deleted == nil {
+		return thr, echo.NewHTTPError(http.StatusConflict, "Thread is not deleted")
+	}
+
+	var postCount int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM posts WHERE thread = $1 AND deleted_at IS NULL`, threadId).Scan(&postCount)
+	if err != nil {
+		log.Println(err)
+		return thr, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	sign := 1
+	if delete {
+		sign = -1
+	}
+	err = tx.QueryRow(fmt.Sprintf(`
+        UPDATE threads SET deleted_at = CASE WHEN $2 THEN NOW() ELSE NULL END
+        WHERE id = $1
+        RETURNING %s`,
+		statements.ThreadColumns),
+		threadId, delete,
+	).Scan(threadFields(&thr)...)
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE forums SET threads = threads + $2, posts = posts + $3 WHERE slug = $1`,
+			thr.Forum, sign, sign*postCount,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+            UPDATE status SET threads = threads + $1, posts = posts + $2`,
+			sign, sign*postCount,
+		)
+	}
+	var forumId int
+	if err == nil {
+		err = tx.QueryRow("forum_get_id_by_slug", thr.Forum).Scan(&forumId)
+	}
+	if err == nil {
+		err = forumUsersCountThread(tx, forumId, threadId, delete)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return thr, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return thr, nil
+}
+
+func ThreadTrash(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	forumSlug := c.Param("slug")
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = 100
+	}
+
+	err = db.QueryRow("forum_get_slug_by_slug", forumSlug).Scan(&forumSlug)
+	if err != nil || !forumVisible(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found")
+	}
+	if !forumModerator(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can see the trash")
+	}
+
+	rows, err := db.Query("thread_list_deleted", forumSlug, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	threads := make([]models.Thread, 0)
+	for rows.Next() {
+		thr := models.Thread{}
+		err := rows.Scan(threadFields(&thr)...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		threads = append(threads, thr)
+	}
+
+	return c.JSON(http.StatusOK, threads)
+}
+
+// threadParticipants aggregates the contribution of every author of thread $2 in forum_users terms
+const threadParticipants = `
+    SELECT u.id AS user_id, SUM(a.posts) AS posts, SUM(a.threads) AS threads, MIN(a.created) AS first_active, MAX(a.created) AS last_active
+    FROM (
+        SELECT author, 0 AS posts, 1 AS threads, created FROM threads WHERE id = $2
+        UNION ALL
+        SELECT author, 1 AS posts, 0 AS threads, created FROM posts WHERE thread = $2 AND deleted_at IS NULL
+    ) a
+        INNER JOIN users u ON u.nickname = a.author
+    GROUP BY u.id`
+
+// forumUsersCountThread adds the authors of a thread to the forum_users counters of a forum or,
+// with remove, takes them out. The thread must already be out of the forum's live content when removing:
+// users left with nothing are dropped and the activity range of the others is recomputed.
+func forumUsersCountThread(tx *pgx.Tx, forumId int, threadId int, remove bool) error {
+	if !remove {
+		_, err := tx.Exec(fmt.Sprintf(`
+            INSERT INTO forum_users (forum_id, user_id, posts, threads, first_active, last_active)
+            SELECT $1, user_id, posts, threads, first_active, last_active FROM (%s) p
+            ON CONFLICT (forum_id, user_id) DO UPDATE SET
+                posts = forum_users.posts + EXCLUDED.posts,
+                threads = forum_users.threads + EXCLUDED.threads,
+                first_active = LEAST(forum_users.first_active, EXCLUDED.first_active),
+                last_active = GREATEST(forum_users.last_active, EXCLUDED.last_active)`,
+			threadParticipants),
+			forumId, threadId,
+		)
+		return err
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(`
+        UPDATE forum_users fu SET posts = fu.posts - p.posts, threads = fu.threads - p.threads
+        FROM (%s) p
+        WHERE fu.forum_id = $1 AND fu.user_id = p.user_id`,
+		threadParticipants),
+		forumId, threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        DELETE FROM forum_users WHERE forum_id = $1 AND posts <= 0 AND threads <= 0`,
+		forumId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`
+        UPDATE forum_users fu SET first_active = a.first_active, last_active = a.last_active
+        FROM (
+            SELECT u.id AS user_id, MIN(x.created) AS first_active, MAX(x.created) AS last_active
+            FROM (
+                SELECT t.author, t.created FROM threads t
+                WHERE t.forum = (SELECT slug FROM forums WHERE id = $1) AND t.deleted_at IS NULL
+                UNION ALL
+                SELECT p.author, p.created FROM posts p
+                    INNER JOIN threads t ON t.id = p.thread
+                WHERE p.forum = (SELECT slug FROM forums WHERE id = $1) AND p.deleted_at IS NULL AND t.deleted_at IS NULL
+            ) x
+                INNER JOIN users u ON u.nickname = x.author
+            WHERE u.id IN (SELECT user_id FROM (%s) p)
+            GROUP BY u.id
+        ) a
+        WHERE fu.forum_id = $1 AND fu.user_id = a.user_id`,
+		threadParticipants),
+		forumId, threadId,
+	)
+	return err
+}
+
+func ThreadMove(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	move := models.ThreadMove{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&move)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || !threadVisible(db, forumSlug, deleted, move.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, move.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can move threads")
+	}
+
+	var targetId int
+	err = db.QueryRow("forum_get_id_by_slug", move.Forum).Scan(&targetId)
+	if err != nil || !forumVisible(db, move.Forum, move.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found!")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var sourceId int
+	err = tx.QueryRow(`
+        SELECT f.id, t.deleted_at
+        FROM threads t
+            INNER JOIN forums f ON f.slug = t.forum
+        WHERE t.id = $1
+        FOR UPDATE OF t`,
+		threadId,
+	).Scan(&sourceId, &deleted)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if sourceId == targetId {
+		return echo.NewHTTPError(http.StatusConflict, "Thread is already in this forum")
+	}
+
+	var postCount int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM posts WHERE thread = $1 AND deleted_at IS NULL`, threadId).Scan(&postCount)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	thr := models.Thread{}
+	err = tx.QueryRow(fmt.Sprintf(`
+        UPDATE threads SET forum = (SELECT slug FROM forums WHERE id = $2)
+        WHERE id = $1
+        RETURNING %s`,
+		statements.ThreadColumns),
+		threadId, targetId,
+	).Scan(threadFields(&thr)...)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE posts SET forum = $2 WHERE thread = $1`, threadId, thr.Forum)
+	}
+	// soft-deleted threads are already out of the counters
+	if err == nil && deleted == nil {
+		_, err = tx.Exec(`
+            UPDATE forums SET
+                threads = threads + CASE WHEN id = $2 THEN 1 ELSE -1 END,
+                posts = posts + CASE WHEN id = $2 THEN $3 ELSE -$3 END
+            WHERE id = $1 OR id = $2`,
+			sourceId, targetId, postCount,
+		)
+	}
+	if err == nil && deleted == nil {
+		err = forumUsersCountThread(tx, targetId, threadId, false)
+	}
+	if err == nil && deleted == nil {
+		err = forumUsersCountThread(tx, sourceId, threadId, true)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, thr)
+}
+
+func ThreadModerate(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	flags := models.ThreadFlags{}
+	defer c.Request().Body.Close()
+	err := json.NewDecoder(c.Request().Body).Decode(&flags)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	threadId, forumSlug, deleted, err := threadGetIdForum(db, c.Param("slug_or_id"))
+	if err != nil || !threadVisible(db, forumSlug, deleted, flags.Nickname) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thread was not found!")
+	}
+	if !forumModerator(db, forumSlug, flags.Nickname) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only moderators can change thread flags")
+	}
+
+	thr := models.Thread{}
+	err = db.QueryRow(fmt.Sprintf(`
+        UPDATE threads SET
+            pinned = COALESCE($2, pinned),
+            locked = COALESCE($3, locked),
+            announcement = COALESCE($4, announcement)
+        WHERE id = $1
+        RETURNING %s`,
+		statements.ThreadColumns),
+		threadId, flags.Pinned, flags.Locked, flags.Announcement,
+	).Scan(threadFields(&thr)...)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, thr)
+}
+
+func ThreadTags(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	forumSlug := c.Param("slug")
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = 100
+	}
+
+	err = db.QueryRow("forum_get_slug_by_slug", forumSlug).Scan(&forumSlug)
+	if err != nil || !forumVisible(db, forumSlug, c.QueryParam("nickname")) {
+		return echo.NewHTTPError(http.StatusNotFound, "Forum was not found")
+	}
+
+	rows, err := db.Query("forum_tags", forumSlug, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	tags := make([]models.TagCount, 0)
+	for rows.Next() {
+		tag := models.TagCount{}
+		err := rows.Scan(&tag.Tag, &tag.Count)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		tags = append(tags, tag)
+	}
+
+	return c.JSON(http.StatusOK, tags)
+}
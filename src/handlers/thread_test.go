@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/utils"
+)
+
+// testServer runs the handlers against TEST_DATABASE_URL, whose tables are dropped and created anew.
+// Tests that need it are skipped when the variable is not set.
+func testServer(t *testing.T) *echo.Echo {
+	uri := os.Getenv("TEST_DATABASE_URL")
+	if len(uri) == 0 {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := pgx.ParseURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: conn, MaxConnections: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	err = utils.ClearDB(db)
+	if err == nil {
+		err = utils.CreateTables(db)
+	}
+	if err == nil {
+		err = utils.PrepareQueries(db)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return h(&utils.ContextAndDb{Context: c, DB: db})
+		}
+	})
+	e.POST("/api/user/:nickname/create", UserCreate)
+	e.POST("/api/forum/create", ForumCreate)
+	e.POST("/api/forum/:slug/create", ThreadCreate)
+	e.GET("/api/forum/:slug/threads", ThreadList)
+	return e
+}
+
+func testRequest(t *testing.T, e *echo.Echo, method string, target string, body interface{}, status int, result interface{}) {
+	var payload string
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = string(data)
+	}
+
+	req := httptest.NewRequest(method, target, strings.NewReader(payload))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, target, rec.Code, status, rec.Body.String())
+	}
+	if result != nil {
+		err := json.Unmarshal(rec.Body.Bytes(), result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestThreadCreateAndListByTags(t *testing.T) {
+	e := testServer(t)
+
+	testRequest(t, e, http.MethodPost, "/api/user/alice/create",
+		models.User{Email: "alice@example.com", Fullname: "Alice"}, http.StatusCreated, nil)
+	testRequest(t, e, http.MethodPost, "/api/forum/create",
+		models.Forum{Slug: "go", Title: "Go", User: "alice"}, http.StatusCreated, nil)
+
+	created := models.Thread{}
+	testRequest(t, e, http.MethodPost, "/api/forum/go/create",
+		models.Thread{Author: "alice", Title: "Generics", Message: "Type parameters", Tags: []string{"Lang", " generics ", "lang"}},
+		http.StatusCreated, &created)
+	if len(created.Tags) != 2 || created.Tags[0] != "Lang" || created.Tags[1] != "generics" {
+		t.Errorf("created tags = %q, want [Lang generics]", created.Tags)
+	}
+	testRequest(t, e, http.MethodPost, "/api/forum/go/create",
+		models.Thread{Author: "alice", Title: "Modules", Message: "go.mod"},
+		http.StatusCreated, nil)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 2},
+		{"?tags=LANG", 1},
+		{"?tags=lang,modules", 1},
+		{"?tags=lang,modules&tags_mode=all", 0},
+		{"?tags=lang,generics&tags_mode=all", 1},
+	}
+	for _, test := range tests {
+		threads := make([]models.Thread, 0)
+		testRequest(t, e, http.MethodGet, "/api/forum/go/threads"+test.query, nil, http.StatusOK, &threads)
+		if len(threads) != test.want {
+			t.Errorf("threads%s: %d threads, want %d", test.query, len(threads), test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx"
+	"github.com/labstack/echo/v4"
+
+	"tp_db_homework/src/models"
+	"tp_db_homework/src/utils"
+)
+
+// how many streamed posts get their markup and attachments loaded at once
+const postTreeChunk = 100
+
+// postListNested reads ?format: flat is the plain list, nested builds reply trees
+// and needs a sort that pages whole trees
+func postListNested(c echo.Context, sort string) (bool, error) {
+	format := c.QueryParam("format")
+	if len(format) == 0 || format == "flat" {
+		return false, nil
+	}
+	if format != "nested" {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "format must be flat or nested")
+	}
+	if !utils.StringInList(sort, []string{"tree", "parent_tree", "top"}) {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "format=nested needs sort tree, parent_tree or top")
+	}
+	return true, nil
+}
+
+// postsStreamTrees writes the root posts of rows as a JSON array with their replies nested in children.
+// Rows come root by root in tree order, so a tree is complete once the next root shows up
+// and is sent right away. The next page cursor is known at the end only and goes out as a trailer,
+// scored cursors also carry the score of the last root as the top sort pages by it.
+func postsStreamTrees(c echo.Context, db *pgx.ConnPool, rows *pgx.Rows, markup string, limit int, scored bool) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.Header().Set("Trailer", utils.CursorHeader)
+	res.WriteHeader(http.StatusOK)
+
+	var roots, nodes []*models.PostTree
+	var byId map[int]*models.PostTree
+	sent := 0
+
+	flush := func() error {
+		if len(roots) == 0 {
+			return nil
+		}
+		posts := make([]models.Post, len(nodes))
+		for i, node := range nodes {
+			posts[i] = node.Post
+		}
+		err := postsApplyMarkup(db, posts, markup)
+		if err == nil {
+			err = postsLoadAttachments(db, posts)
+		}
+		if err != nil {
+			return err
+		}
+		for i, node := range nodes {
+			node.Post = posts[i]
+		}
+
+		for _, root := range roots {
+			data, err := json.Marshal(root)
+			if err != nil {
+				return err
+			}
+			if sent == 0 {
+				_, err = res.Write([]byte("["))
+			} else {
+				_, err = res.Write([]byte(","))
+			}
+			if err == nil {
+				_, err = res.Write(data)
+			}
+			if err != nil {
+				return err
+			}
+			sent++
+		}
+		res.Flush()
+
+		roots, nodes = nil, nil
+		return nil
+	}
+
+	var lastRoot, lastRootScore int
+	for rows.Next() {
+		node := &models.PostTree{Children: make([]*models.PostTree, 0)}
+		post := &node.Post
+		err := rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent, &post.IsDeleted, &post.Score)
+		if err == nil && post.Parent == 0 && len(nodes) >= postTreeChunk {
+			err = flush()
+		}
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+
+		if post.Parent == 0 {
+			byId = map[int]*models.PostTree{post.Id: node}
+			roots = append(roots, node)
+			lastRoot, lastRootScore = post.Id, post.Score
+		} else {
+			parent := byId[post.Parent]
+			if parent == nil {
+				continue
+			}
+			parent.Children = append(parent.Children, node)
+			byId[post.Id] = node
+		}
+		nodes = append(nodes, node)
+	}
+
+	err := rows.Err()
+	if err == nil {
+		err = flush()
+	}
+	if err == nil && sent == 0 {
+		_, err = res.Write([]byte("["))
+	}
+	if err == nil {
+		_, err = res.Write([]byte("]"))
+	}
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	if limit > 0 && sent == limit {
+		next := utils.Cursor{Id: lastRoot}
+		if scored {
+			next.Score = &lastRootScore
+		}
+		res.Header().Set(utils.CursorHeader, utils.EncodeCursor(next))
+	}
+	return nil
+}
@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 
@@ -131,3 +133,99 @@ func UserUpdate(c echo.Context) error {
 
 	return c.JSON(200, user)
 }
+
+// UserMentions lists the posts that mention a user, newest first unless ?desc=false.
+// Posts of deleted threads and private forums ?nickname can not see are left out.
+func UserMentions(c echo.Context) error {
+	db := c.(*utils.ContextAndDb).DB
+
+	markup, err := markupMode(c)
+	if err != nil {
+		return err
+	}
+
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = 100
+	}
+
+	desc, err := strconv.ParseBool(c.QueryParam("desc"))
+	if err != nil {
+		desc = true
+	}
+
+	since, err := strconv.Atoi(c.QueryParam("since"))
+	if err != nil {
+		since = 0
+	}
+	if len(c.QueryParam("cursor")) > 0 {
+		cursor, err := utils.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil || cursor.Id == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+		}
+		since = cursor.Id
+	}
+
+	var userId int
+	err = db.QueryRow(`SELECT id FROM users WHERE nickname = $1`, c.Param("nickname")).Scan(&userId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found!")
+	}
+
+	order, cmp := "ASC", ">"
+	if desc {
+		order, cmp = "DESC", "<"
+	}
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT p.author, p.created, p.forum, p.id, p.message, p.thread, p.parent, p.is_edited, p.score
+        FROM post_mentions m
+            INNER JOIN posts p ON p.id = m.post_id
+            INNER JOIN threads t ON t.id = p.thread
+            INNER JOIN forums f ON f.slug = p.forum
+        WHERE m.user_id = $1 AND ($3 = 0 OR m.post_id %s $3)
+            AND p.deleted_at IS NULL AND t.deleted_at IS NULL
+            AND (NOT f.is_private OR EXISTS (
+                SELECT 1 FROM forum_members fm
+                    INNER JOIN users u ON u.id = fm.user_id
+                WHERE fm.forum_id = f.id AND u.nickname = $4
+            ))
+        ORDER BY m.post_id %s
+        LIMIT $2`,
+		cmp, order),
+		userId, limit, since, c.QueryParam("nickname"),
+	)
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	posts := make([]models.Post, 0)
+	for rows.Next() {
+		post := models.Post{}
+		err = rows.Scan(&post.Author, &post.Created, &post.Forum, &post.Id, &post.Message, &post.Thread, &post.Parent, &post.IsEdited, &post.Score)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if limit > 0 && len(posts) == limit {
+		c.Response().Header().Set(utils.CursorHeader, utils.EncodeCursor(utils.Cursor{Id: posts[len(posts)-1].Id}))
+	}
+
+	err = postsApplyMarkup(db, posts, markup)
+	if err == nil {
+		err = postsLoadAttachments(db, posts)
+	}
+	if err != nil {
+		log.Println(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, posts)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/labstack/echo/v4"
     "github.com/labstack/echo-contrib/prometheus"
@@ -25,11 +26,19 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	utils.StartThreadPurge(db, 30*24*time.Hour, time.Hour)
+	utils.StartViewFlush(db, utils.ThreadViews, 10*time.Second)
+
+	utils.Blobs, err = utils.NewLocalStorage("attachments")
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.StartAttachmentGC(db, utils.Blobs, 24*time.Hour, time.Hour)
 
 	e := echo.New()
 	e.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			cc := &utils.ContextAndDb{c, db}
+			cc := &utils.ContextAndDb{Context: c, DB: db}
 			return h(cc)
 		}
 	})
@@ -43,21 +52,53 @@ func main() {
 	e.POST("/api/user/:nickname/create", handlers.UserCreate)
 	e.GET("/api/user/:nickname/profile", handlers.UserDetails)
 	e.POST("/api/user/:nickname/profile", handlers.UserUpdate)
+	e.GET("/api/user/:nickname/mentions", handlers.UserMentions)
 
 	e.POST("/api/forum/create", handlers.ForumCreate)
+	e.POST("/api/forum/import", handlers.ForumImport)
 	e.GET("/api/forum/:slug/details", handlers.ForumDetails)
 	e.GET("/api/forum/:slug/users", handlers.ForumUsers)
+	e.GET("/api/forum/:slug/posts", handlers.ForumPosts)
+	e.GET("/api/forum/:slug/stats", handlers.ForumStats)
+	e.POST("/api/forum/:slug/rename", handlers.ForumRename)
+	e.GET("/api/forum/:slug/export", handlers.ForumExport)
+	e.POST("/api/forum/:slug/invite", handlers.ForumInvite)
+	e.POST("/api/forum/:slug/join", handlers.ForumJoin)
+	e.POST("/api/forum/:slug/leave", handlers.ForumLeave)
+	e.GET("/api/forum/:slug/trash", handlers.ThreadTrash)
+	e.GET("/api/forum/:slug/tags", handlers.ThreadTags)
 
 	e.POST("/api/forum/:slug/create", handlers.ThreadCreate)
 	e.GET("/api/forum/:slug/threads", handlers.ThreadList)
 	e.POST("/api/thread/:slug_or_id/vote", handlers.ThreadVote)
+	e.DELETE("/api/thread/:slug_or_id/vote", handlers.ThreadUnvote)
+	e.GET("/api/thread/:slug_or_id/votes", handlers.ThreadVotes)
+	e.POST("/api/thread/:slug_or_id/poll/vote", handlers.PollVote)
 	e.GET("/api/thread/:slug_or_id/details", handlers.ThreadDetails)
 	e.POST("/api/thread/:slug_or_id/details", handlers.ThreadUpdate)
+	e.POST("/api/thread/:slug_or_id/rename", handlers.ThreadRename)
+	e.DELETE("/api/thread/:slug_or_id", handlers.ThreadDelete)
+	e.POST("/api/thread/:slug_or_id/restore", handlers.ThreadRestore)
+	e.POST("/api/thread/:slug_or_id/move", handlers.ThreadMove)
+	e.POST("/api/thread/:slug_or_id/merge", handlers.ThreadMerge)
+	e.POST("/api/thread/:slug_or_id/moderate", handlers.ThreadModerate)
+	e.GET("/api/thread/:slug_or_id/history", handlers.ThreadHistory)
+	e.POST("/api/thread/:slug_or_id/history/:revision/revert", handlers.ThreadRevert)
 
 	e.POST("/api/thread/:slug_or_id/create", handlers.PostCreate)
 	e.GET("/api/thread/:slug_or_id/posts", handlers.PostList)
 	e.GET("/api/post/:id/details", handlers.PostDetails)
 	e.POST("/api/post/:id/details", handlers.PostUpdate)
+	e.GET("/api/post/:id/replies", handlers.PostReplies)
+	e.GET("/api/post/:id/context", handlers.PostContext)
+	e.POST("/api/post/:id/split", handlers.PostSplit)
+	e.DELETE("/api/post/:id", handlers.PostDelete)
+	e.POST("/api/post/:id/vote", handlers.PostVote)
+	e.GET("/api/post/:id/history", handlers.PostHistory)
+	e.POST("/api/post/:id/history/:revision/revert", handlers.PostRevert)
+
+	e.POST("/api/attachment/upload", handlers.AttachmentUpload)
+	e.GET("/api/attachment/:id", handlers.AttachmentDownload)
 
 	e.Start(":5000")
 
@@ -11,6 +11,14 @@ type User struct {
 	About    string `json:"about"`
 }
 
+type ForumUser struct {
+	User
+	Posts       int       `json:"posts"`
+	Threads     int       `json:"threads"`
+	FirstActive time.Time `json:"firstActive"`
+	LastActive  time.Time `json:"lastActive"`
+}
+
 type UserUpdate struct {
 	Nickname *string `json:"nickname"`
 	Email    *string `json:"email"`
@@ -24,6 +32,29 @@ type Forum struct {
 	Slug    string `json:"slug"`
 	Posts   int    `json:"posts"`
 	Threads int    `json:"threads"`
+	Private bool   `json:"private"`
+}
+
+type ForumInvite struct {
+	Nickname string `json:"nickname"`
+	Invitee  string `json:"invitee"`
+}
+
+type ForumMember struct {
+	Nickname string `json:"nickname"`
+}
+
+type ForumStats struct {
+	Bucket  string `json:"bucket"`
+	Threads int    `json:"threads"`
+	Posts   int    `json:"posts"`
+	Authors int    `json:"authors"`
+	Votes   int    `json:"votes"`
+}
+
+type SlugRename struct {
+	Nickname string `json:"nickname"`
+	Slug     string `json:"slug"`
 }
 
 type ServiceStatus struct {
@@ -34,19 +65,98 @@ type ServiceStatus struct {
 }
 
 type Thread struct {
-	Id      int       `json:"id"`
-	Forum   string    `json:"forum"`
-	Title   string    `json:"title"`
-	Author  string    `json:"author"`
-	Message string    `json:"message"`
-	Created time.Time `json:"created"`
-	Votes   int       `json:"votes"`
-	Slug    string    `json:"slug"`
+	Id      int        `json:"id"`
+	Forum   string     `json:"forum"`
+	Title   string     `json:"title"`
+	Author  string     `json:"author"`
+	Message string     `json:"message"`
+	Created time.Time  `json:"created"`
+	Votes   int        `json:"votes"`
+	Slug    string     `json:"slug"`
+	Deleted *time.Time `json:"deleted,omitempty"`
+
+	Pinned       bool     `json:"pinned"`
+	Locked       bool     `json:"locked"`
+	Announcement bool     `json:"announcement"`
+	Tags         []string `json:"tags"`
+
+	Posts          int        `json:"posts"`
+	LastPostAt     *time.Time `json:"lastPostAt,omitempty"`
+	LastPostAuthor string     `json:"lastPostAuthor,omitempty"`
+
+	Upvotes   int `json:"upvotes"`
+	Downvotes int `json:"downvotes"`
+	Views     int `json:"views"`
+
+	Poll *Poll `json:"poll,omitempty"`
+
+	MessageHtml string `json:"messageHtml,omitempty"`
+}
+
+// Poll hides voters and option votes until the viewer has voted or the poll is closed
+type Poll struct {
+	Id       int          `json:"id"`
+	Question string       `json:"question"`
+	Multiple bool         `json:"multiple"`
+	Closes   *time.Time   `json:"closes,omitempty"`
+	Closed   bool         `json:"closed"`
+	Voted    bool         `json:"voted"`
+	Voters   *int         `json:"voters,omitempty"`
+	Options  []PollOption `json:"options"`
+}
+
+type PollOption struct {
+	Id    int    `json:"id"`
+	Text  string `json:"text"`
+	Votes *int   `json:"votes,omitempty"`
+}
+
+type PollVote struct {
+	Nickname string `json:"nickname"`
+	Options  []int  `json:"options"`
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type ThreadModerator struct {
+	Nickname string `json:"nickname"`
+}
+
+type ThreadMove struct {
+	Nickname string `json:"nickname"`
+	Forum    string `json:"forum"`
+}
+
+// ThreadMerge moves every post of a thread into Target under the post Parent, 0 meaning the top level
+type ThreadMerge struct {
+	Nickname string `json:"nickname"`
+	Target   string `json:"target"`
+	Parent   int    `json:"parent"`
+}
+
+// PostSplit describes the thread made out of a post subtree; Message defaults to the message of the post
+type PostSplit struct {
+	Nickname string  `json:"nickname"`
+	Title    string  `json:"title"`
+	Slug     string  `json:"slug"`
+	Message  *string `json:"message"`
+}
+
+type ThreadFlags struct {
+	Nickname     string `json:"nickname"`
+	Pinned       *bool  `json:"pinned"`
+	Locked       *bool  `json:"locked"`
+	Announcement *bool  `json:"announcement"`
 }
 
 type ThreadUpdate struct {
-	Title   *string `json:"title"`
-	Message *string `json:"message"`
+	Nickname string    `json:"nickname"`
+	Title    *string   `json:"title"`
+	Message  *string   `json:"message"`
+	Tags     *[]string `json:"tags"`
 }
 
 type Post struct {
@@ -58,10 +168,56 @@ type Post struct {
 	Forum    string    `json:"forum"`
 	Thread   int       `json:"thread"`
 	Created  time.Time `json:"created"`
+
+	IsDeleted bool `json:"isDeleted,omitempty"`
+	Score     int  `json:"score"`
+
+	MessageHtml string `json:"messageHtml,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	ThreadTitle string `json:"threadTitle,omitempty"`
+}
+
+// PostTree is a post with its replies, the nested format of post listings
+type PostTree struct {
+	Post
+	Children []*PostTree `json:"children"`
+}
+
+// Attachment is an uploaded file. Posts refer to uploads by id only when they are created.
+type Attachment struct {
+	Id          int        `json:"id"`
+	Filename    string     `json:"filename,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Size        int        `json:"size,omitempty"`
+	Sha256      string     `json:"sha256,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+}
+
+type PostVote struct {
+	Nickname string `json:"nickname"`
+	Voice    int    `json:"voice"`
+}
+
+type ArchivePost struct {
+	Post
+	Path []int32 `json:"path"`
 }
 
 type PostUpdate struct {
-	Message *string `json:"message"`
+	Nickname string  `json:"nickname"`
+	Message  *string `json:"message"`
+}
+
+// Revision is the content replaced by an edit; Diff leads from it to the content that replaced it
+type Revision struct {
+	Id      int       `json:"id"`
+	Editor  string    `json:"editor,omitempty"`
+	Created time.Time `json:"created"`
+	Title   string    `json:"title,omitempty"`
+	Message string    `json:"message"`
+	Diff    string    `json:"diff"`
 }
 
 type PostDetails struct {
@@ -77,3 +233,40 @@ type ThreadVote struct {
 	Nickname string `json:"nickname"`
 	Voice    int    `json:"voice"`
 }
+
+type ThreadVotes struct {
+	Upvotes   int          `json:"upvotes"`
+	Downvotes int          `json:"downvotes"`
+	Votes     []ThreadVote `json:"votes"`
+}
+
+// ArchiveAttachment is an attachment of an archived post, its content is the blobs/<sha256> entry of the archive
+type ArchiveAttachment struct {
+	Attachment
+	Post     int    `json:"post"`
+	Uploader string `json:"uploader"`
+}
+
+type ArchivePostVote struct {
+	Post     int    `json:"post"`
+	Nickname string `json:"nickname"`
+	Voice    int    `json:"voice"`
+}
+
+// ArchivePoll is the poll of an archived thread, poll votes refer to the ids of its options
+type ArchivePoll struct {
+	Poll
+	Thread int `json:"thread"`
+}
+
+type ArchivePollVote struct {
+	Option   int    `json:"option"`
+	Nickname string `json:"nickname"`
+}
+
+type ArchiveManifest struct {
+	Version  int            `json:"version"`
+	Forum    string         `json:"forum"`
+	Exported time.Time      `json:"exported"`
+	Counts   map[string]int `json:"counts"`
+}
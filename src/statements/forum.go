@@ -1,73 +1,165 @@
 package statements
 
 import (
+	"fmt"
+
 	"github.com/jackc/pgx"
 )
 
 func ForumPrepare(db *pgx.ConnPool) error {
-	_, err := db.Prepare("forum_get_id_by_slug", `SELECT id FROM forums WHERE slug = $1`)
+	// slugs left behind by renames stay in forum_slug_aliases and are resolved transparently
+	_, err := db.Prepare("forum_get_id_by_slug", `
+        SELECT id FROM forums
+        WHERE slug = COALESCE((SELECT f.slug FROM forum_slug_aliases a INNER JOIN forums f ON f.id = a.forum_id WHERE a.slug = $1), $1)`,
+	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("forum_get_slug_by_slug", `SELECT slug FROM forums WHERE slug = $1`)
+	_, err = db.Prepare("forum_get_slug_by_slug", `
+        SELECT slug FROM forums
+        WHERE slug = COALESCE((SELECT f.slug FROM forum_slug_aliases a INNER JOIN forums f ON f.id = a.forum_id WHERE a.slug = $1), $1)`,
+	)
 	if err != nil {
 		return err
 	}
 
 	_, err = db.Prepare("forum_get_by_slug", `
-        SELECT slug, title, user_nickname, threads, posts
+        SELECT slug, title, user_nickname, threads, posts, is_private
         FROM forums
-        WHERE slug = $1
+        WHERE slug = COALESCE((SELECT f.slug FROM forum_slug_aliases a INNER JOIN forums f ON f.id = a.forum_id WHERE a.slug = $1), $1)
         LIMIT 1`,
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("forum_users_desc_since", `
-        SELECT about, email, fullname, nickname
-        FROM forum_users fu
-            INNER JOIN users u ON u.id = fu.user_id
-        WHERE forum_id = $1 AND nickname < $3
-        ORDER BY nickname DESC
-        LIMIT $2`,
+	// private forums are visible to their members only
+	_, err = db.Prepare("forum_is_visible", `
+        SELECT NOT is_private OR EXISTS (
+            SELECT 1 FROM forum_members m
+                INNER JOIN users u ON u.id = m.user_id
+            WHERE m.forum_id = f.id AND u.nickname = $2
+        )
+        FROM forums f
+        WHERE slug = COALESCE((SELECT f.slug FROM forum_slug_aliases a INNER JOIN forums f ON f.id = a.forum_id WHERE a.slug = $1), $1)`,
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("forum_users_desc", `
-        SELECT about, email, fullname, nickname
-        FROM forum_users fu
-            INNER JOIN users u ON u.id = fu.user_id
-        WHERE forum_id = $1
-        ORDER BY nickname DESC
-        LIMIT $2`,
+	// forum owners moderate their forums
+	_, err = db.Prepare("forum_is_moderator", `
+        SELECT EXISTS (SELECT 1 FROM forums WHERE slug = $1 AND user_nickname = $2)`,
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("forum_users_asc_since", `
-        SELECT about, email, fullname, nickname
-        FROM forum_users fu
-            INNER JOIN users u ON u.id = fu.user_id
-        WHERE forum_id = $1 AND nickname > $3
-        ORDER BY nickname ASC
-        LIMIT $2`,
+	_, err = db.Prepare("forum_members_add", `
+        INSERT INTO forum_members (forum_id, user_id) VALUES ($1, $2)
+        ON CONFLICT DO NOTHING`,
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("forum_users_asc", `
-        SELECT about, email, fullname, nickname
+	// forum_users_<sort>_<order>[_since]; since is always the nickname of the last user on the previous page
+	forumUsersSorts := map[string]string{
+		"nickname":    "nickname",
+		"posts":       "fu.posts",
+		"last_active": "fu.last_active",
+	}
+	for sort, column := range forumUsersSorts {
+		for _, order := range []string{"asc", "desc"} {
+			cmp := ">"
+			if order == "desc" {
+				cmp = "<"
+			}
+
+			orderBy := fmt.Sprintf("nickname %s", order)
+			sinceCond := fmt.Sprintf("nickname %s $3", cmp)
+			if sort != "nickname" {
+				orderBy = fmt.Sprintf("%s %s, nickname %s", column, order, order)
+				sinceCond = fmt.Sprintf(`(%s, nickname) %s (
+                SELECT %s, nickname FROM forum_users fu
+                    INNER JOIN users u ON u.id = fu.user_id
+                WHERE forum_id = $1 AND nickname = $3
+            )`, column, cmp, column)
+			}
+
+			_, err = db.Prepare("forum_users_"+sort+"_"+order+"_since", fmt.Sprintf(`
+        SELECT about, email, fullname, nickname, fu.posts, fu.threads, fu.first_active, fu.last_active
+        FROM forum_users fu
+            INNER JOIN users u ON u.id = fu.user_id
+        WHERE forum_id = $1 AND %s
+        ORDER BY %s
+        LIMIT $2`, sinceCond, orderBy),
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = db.Prepare("forum_users_"+sort+"_"+order, fmt.Sprintf(`
+        SELECT about, email, fullname, nickname, fu.posts, fu.threads, fu.first_active, fu.last_active
         FROM forum_users fu
             INNER JOIN users u ON u.id = fu.user_id
         WHERE forum_id = $1
-        ORDER BY nickname ASC
-        LIMIT $2`,
+        ORDER BY %s
+        LIMIT $2`, orderBy),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = db.Prepare("forum_users_add", `
+        INSERT INTO forum_users (forum_id, user_id, posts, threads) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (forum_id, user_id) DO UPDATE SET
+            posts = forum_users.posts + EXCLUDED.posts,
+            threads = forum_users.threads + EXCLUDED.threads,
+            last_active = NOW()`,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("forum_stats_add", `
+        INSERT INTO forum_stats (forum_id, day, threads, posts, votes) VALUES ($1, CURRENT_DATE, $2, $3, $4)
+        ON CONFLICT (forum_id, day) DO UPDATE SET
+            threads = forum_stats.threads + EXCLUDED.threads,
+            posts = forum_stats.posts + EXCLUDED.posts,
+            votes = forum_stats.votes + EXCLUDED.votes`,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("forum_stats_authors_add", `
+        INSERT INTO forum_stats_authors (forum_id, day, user_id)
+        SELECT $1, CURRENT_DATE, unnest($2::int[])
+        ON CONFLICT DO NOTHING`,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("forum_stats", `
+        WITH buckets AS (
+            SELECT b::date AS bucket, (b + ('1 ' || $4)::interval)::date AS bucket_end
+            FROM generate_series(date_trunc($4, $2::timestamp), $3::timestamp, ('1 ' || $4)::interval) b
+        )
+        SELECT b.bucket,
+            COALESCE(SUM(s.threads), 0), COALESCE(SUM(s.posts), 0), COALESCE(SUM(s.votes), 0),
+            (
+                SELECT COUNT(DISTINCT a.user_id) FROM forum_stats_authors a
+                WHERE a.forum_id = $1 AND a.day >= b.bucket AND a.day < b.bucket_end AND a.day BETWEEN $2 AND $3
+            )
+        FROM buckets b
+            LEFT JOIN forum_stats s ON s.forum_id = $1 AND s.day >= b.bucket AND s.day < b.bucket_end AND s.day BETWEEN $2 AND $3
+        GROUP BY b.bucket, b.bucket_end
+        ORDER BY b.bucket`,
 	)
 	if err != nil {
 		return err
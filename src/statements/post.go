@@ -1,12 +1,14 @@
 package statements
 
 import (
+	"fmt"
+
 	"github.com/jackc/pgx"
 )
 
 func PostPrepare(db *pgx.ConnPool) error {
 	_, err := db.Prepare("post_get_by_id", `
-        SELECT parent, author, created, forum, id, message, thread, is_edited
+        SELECT parent, author, created, forum, id, message, thread, is_edited, deleted_at IS NOT NULL, score
         FROM posts
         WHERE id = $1
         LIMIT 1`,
@@ -16,7 +18,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_desc_flat", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1
 		ORDER BY id DESC
@@ -27,7 +29,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_desc_flat_since", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1 AND id < $3
 		ORDER BY id DESC
@@ -38,7 +40,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_desc_tree_since", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1 AND path < (SELECT path FROM posts WHERE id = $3)
 		ORDER BY path DESC
@@ -48,7 +50,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_desc_tree", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1
 		ORDER BY path DESC
@@ -58,7 +60,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_desc_parent_tree_since", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE path[2] IN (
 			SELECT id FROM posts
@@ -72,7 +74,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_desc_parent_tree", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE path[2] IN (
 			SELECT id FROM posts
@@ -86,7 +88,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_asc_flat_since", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1 AND id > $3
 		ORDER BY id ASC
@@ -96,7 +98,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_asc_flat", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1
 		ORDER BY id ASC
@@ -106,7 +108,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_asc_tree_since", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1 AND path > (SELECT path FROM posts WHERE id = $3)
 		ORDER BY path ASC
@@ -116,7 +118,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_asc_tree", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE thread = $1
 		ORDER BY path ASC
@@ -126,7 +128,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_asc_parent_tree_since", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE path[2] IN (
 			SELECT id FROM posts
@@ -140,7 +142,7 @@ func PostPrepare(db *pgx.ConnPool) error {
 	}
 
 	_, err = db.Prepare("post_list_asc_parent_tree", `
-		SELECT author, created, forum, id, message, thread, parent
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
 		FROM posts
 		WHERE path[2] IN (
 			SELECT id FROM posts
@@ -153,5 +155,92 @@ func PostPrepare(db *pgx.ConnPool) error {
 		return err
 	}
 
+	// post_list_asc_top[_since|_cursor] pages root posts like parent_tree, but roots go by score and so do
+	// replies within every subtree. The order is always best first, there is no desc variant. since is any
+	// post of the last tree and resumes after the current score of its root, so pages shift when that score
+	// changes in between. The _cursor variant resumes after the (score, id) the root had when it was listed.
+	topTree := `
+		WITH RECURSIVE roots AS (
+			SELECT id FROM posts
+			WHERE thread = $1 AND parent = 0 %s
+			ORDER BY score DESC, id ASC
+			LIMIT $2
+		), tree AS (
+			SELECT p.id, p.author, p.created, p.forum, p.message, p.thread, p.parent, p.deleted_at, p.score,
+				ARRAY[-p.score, p.id] AS sort_key
+			FROM posts p
+				INNER JOIN roots r ON r.id = p.id
+			UNION ALL
+			SELECT p.id, p.author, p.created, p.forum, p.message, p.thread, p.parent, p.deleted_at, p.score,
+				t.sort_key || ARRAY[-p.score, p.id]
+			FROM posts p
+				INNER JOIN tree t ON p.thread = $1 AND p.parent = t.id
+		)
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
+		FROM tree
+		ORDER BY sort_key`
+	topSince := `AND (-score, id) > (
+				SELECT -score, id FROM posts WHERE id = (SELECT path[2] FROM posts WHERE id = $3)
+			)`
+	topCursor := `AND (-score, id) > (-$3::int, $4::int)`
+	_, err = db.Prepare("post_list_asc_top_cursor", fmt.Sprintf(topTree, topCursor))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("post_list_asc_top_since", fmt.Sprintf(topTree, topSince))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("post_list_asc_top", fmt.Sprintf(topTree, ""))
+	if err != nil {
+		return err
+	}
+
+	// post_replies[_since] walk the subtree of the post with path $1 in path order: descendants are exactly
+	// the paths between $1 and $1 || MAX(int), so the range is served by post_path. $3 caps the path length.
+	_, err = db.Prepare("post_replies", `
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
+		FROM posts
+		WHERE path > $1::int[] AND path < $1::int[] || 2147483647
+			AND ($3 = 0 OR array_length(path, 1) <= $3)
+		ORDER BY path ASC
+		LIMIT $2`,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("post_replies_since", `
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
+		FROM posts
+		WHERE path > GREATEST($1::int[], (SELECT path FROM posts WHERE id = $4)) AND path < $1::int[] || 2147483647
+			AND ($3 = 0 OR array_length(path, 1) <= $3)
+		ORDER BY path ASC
+		LIMIT $2`,
+	)
+	if err != nil {
+		return err
+	}
+
+	// post_context lists the ancestors of a post from its root down, their ids are its path
+	_, err = db.Prepare("post_context", `
+		SELECT author, created, forum, id, message, thread, parent, deleted_at IS NOT NULL, score
+		FROM posts
+		WHERE id = ANY((SELECT path[2:array_length(path, 1) - 1] FROM posts WHERE id = $1)::int[])
+		ORDER BY path ASC`,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Prepare("post_vote_get", `
+		SELECT voice FROM post_votes WHERE post_id = $1 AND user_id = $2`,
+	)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
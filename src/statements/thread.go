@@ -1,75 +1,138 @@
 package statements
 
 import (
+	"fmt"
+
 	"github.com/jackc/pgx"
 )
 
+// ThreadColumns is the column list every thread query returns, in the order of handlers.threadFields
+const ThreadColumns = "author, created, forum, id, message, slug, title, votes, deleted_at, pinned, locked, announcement, tags::text[], " +
+	"posts, last_post_at, COALESCE(last_post_author, ''), upvotes, downvotes, views"
+
 func ThreadPrepare(db *pgx.ConnPool) error {
-	_, err := db.Prepare("thread_get_forum_by_id", `SELECT forum FROM threads WHERE id = $1 LIMIT 1`)
+	_, err := db.Prepare("thread_get_forum_by_id", `SELECT forum, deleted_at FROM threads WHERE id = $1 LIMIT 1`)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("thread_get_id_forum_by_slug", `SELECT id, forum FROM threads WHERE slug = $1 LIMIT 1`)
+	// slugs left behind by renames stay in thread_slug_aliases and are resolved transparently.
+	// A live slug wins over an alias spelled the same, which imports leave behind for slugs they had to replace.
+	_, err = db.Prepare("thread_get_id_forum_by_slug", `
+        SELECT id, forum, deleted_at FROM threads
+        WHERE slug = COALESCE(
+            (SELECT slug FROM threads WHERE slug = $1),
+            (SELECT t.slug FROM thread_slug_aliases a INNER JOIN threads t ON t.id = a.thread_id WHERE a.slug = $1),
+            $1
+        )
+        LIMIT 1`,
+	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("thread_get_by_id", `
-        SELECT author, created, forum, message, slug, title, votes
+	_, err = db.Prepare("thread_get_by_id", fmt.Sprintf(`
+        SELECT %s
         FROM threads
         WHERE id = $1
-        LIMIT 1`,
+        LIMIT 1`, ThreadColumns),
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("thread_get_by_slug", `
-        SELECT author, created, forum, id, message, slug, title, votes
+	_, err = db.Prepare("thread_get_by_slug", fmt.Sprintf(`
+        SELECT %s
         FROM threads
-        WHERE slug = $1
-        LIMIT 1`,
+        WHERE slug = COALESCE(
+            (SELECT slug FROM threads WHERE slug = $1),
+            (SELECT t.slug FROM thread_slug_aliases a INNER JOIN threads t ON t.id = a.thread_id WHERE a.slug = $1),
+            $1
+        )
+        LIMIT 1`, ThreadColumns),
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("thread_list_desc_since", `
-        SELECT author, created, forum, id, message, slug, title, votes FROM threads
-        WHERE forum = $1 AND created <= $3
-        ORDER BY created DESC
-        LIMIT $2`,
-	)
-	if err != nil {
-		return err
+	// thread_list_<sort>_<order>[_since]. Pinned threads come first, so the keyset of a page is (pinned, key, id).
+	// since is the id of the last thread of the previous page for every sort but created, where it is a creation
+	// time that filters the list rather than pages it. The created sort pages with the _cursor variant instead,
+	// which continues strictly after the (pinned, created, id) of the last thread, so equal timestamps are not repeated.
+	// A NULL tag list disables the tag filter, otherwise threads need any or all ($all) of the tags.
+	tagsFilter := "($%[1]d::text[]::citext[] IS NULL OR CASE WHEN $%[2]d THEN tags @> $%[1]d::text[]::citext[] ELSE tags && $%[1]d::text[]::citext[] END)"
+	threadSorts := map[string]string{
+		"created":  "created",
+		"activity": "COALESCE(last_post_at, created)",
+		"votes":    "votes",
+		"replies":  "posts",
+		"views":    "views",
 	}
+	for sort, key := range threadSorts {
+		for _, order := range []string{"asc", "desc"} {
+			cmp := ">"
+			if order == "desc" {
+				cmp = "<"
+			}
 
-	_, err = db.Prepare("thread_list_desc", `
-        SELECT author, created, forum, id, message, slug, title, votes FROM threads
-        WHERE forum = $1
-        ORDER BY created DESC
-        LIMIT $2`,
-	)
-	if err != nil {
-		return err
+			orderBy := fmt.Sprintf("pinned DESC, %s %s, id %s", key, order, order)
+			sinceFrom := fmt.Sprintf(", (SELECT pinned AS since_pinned, %s AS since_key, id AS since_id FROM threads WHERE id = $3) l", key)
+			sinceCond := fmt.Sprintf("(pinned < since_pinned OR (pinned = since_pinned AND (%s, id) %s (since_key, since_id)))", key, cmp)
+			if sort == "created" {
+				sinceFrom = ""
+				sinceCond = fmt.Sprintf("created %s= $3", cmp)
+
+				_, err = db.Prepare("thread_list_created_"+order+"_cursor", fmt.Sprintf(`
+        SELECT %s FROM threads
+        WHERE forum = $1 AND (pinned < $8 OR (pinned = $8 AND (created, id) %s ($3, $7))) AND (deleted_at IS NULL OR $4) AND %s
+        ORDER BY %s
+        LIMIT $2`, ThreadColumns, cmp, fmt.Sprintf(tagsFilter, 5, 6), orderBy),
+				)
+				if err != nil {
+					return err
+				}
+			}
+
+			_, err = db.Prepare("thread_list_"+sort+"_"+order+"_since", fmt.Sprintf(`
+        SELECT %s FROM threads%s
+        WHERE forum = $1 AND %s AND (deleted_at IS NULL OR $4) AND %s
+        ORDER BY %s
+        LIMIT $2`, ThreadColumns, sinceFrom, sinceCond, fmt.Sprintf(tagsFilter, 5, 6), orderBy),
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = db.Prepare("thread_list_"+sort+"_"+order, fmt.Sprintf(`
+        SELECT %s FROM threads
+        WHERE forum = $1 AND (deleted_at IS NULL OR $3) AND %s
+        ORDER BY %s
+        LIMIT $2`, ThreadColumns, fmt.Sprintf(tagsFilter, 4, 5), orderBy),
+			)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	_, err = db.Prepare("thread_list_asc_since", `
-        SELECT author, created, forum, id, message, slug, title, votes FROM threads
-        WHERE forum = $1 AND created >= $3
-        ORDER BY created ASC
+	_, err = db.Prepare("forum_tags", `
+        SELECT tag::text, COUNT(*)
+        FROM threads, unnest(tags) AS tag
+        WHERE forum = $1 AND deleted_at IS NULL
+        GROUP BY tag
+        ORDER BY COUNT(*) DESC, tag
         LIMIT $2`,
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Prepare("thread_list_asc", `
-        SELECT author, created, forum, id, message, slug, title, votes FROM threads
-        WHERE forum = $1
-        ORDER BY created ASC
-        LIMIT $2`,
+	// trash bin of a forum, soft-deleted threads are purged by utils.PurgeDeletedThreads
+	_, err = db.Prepare("thread_list_deleted", fmt.Sprintf(`
+        SELECT %s FROM threads
+        WHERE forum = $1 AND deleted_at IS NOT NULL
+        ORDER BY deleted_at DESC
+        LIMIT $2`, ThreadColumns),
 	)
 	if err != nil {
 		return err
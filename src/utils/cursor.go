@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// CursorHeader carries the cursor of the next page in list responses
+const CursorHeader = "X-Next-Cursor"
+
+// Cursor is the position of the last row of a page. Clients get it as an opaque string
+// and pass it back in the cursor query parameter to fetch the next page.
+type Cursor struct {
+	Created  *time.Time `json:"c,omitempty"`
+	Id       int        `json:"i,omitempty"`
+	Nickname string     `json:"n,omitempty"`
+	Pinned   bool       `json:"p,omitempty"`
+	Score    *int       `json:"s,omitempty"`
+}
+
+func EncodeCursor(cursor Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	cursor := Cursor{}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	created := time.Date(2020, 5, 17, 12, 30, 0, 123456000, time.UTC)
+	score := -3
+
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{"empty", Cursor{}},
+		{"created and id", Cursor{Created: &created, Id: 42}},
+		{"pinned", Cursor{Created: &created, Id: 7, Pinned: true}},
+		{"nickname", Cursor{Id: 3, Nickname: "Alice.Smith"}},
+		{"score", Cursor{Id: 11, Score: &score}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := EncodeCursor(test.cursor)
+			decoded, err := DecodeCursor(encoded)
+			if err != nil {
+				t.Fatalf("DecodeCursor(%q): %v", encoded, err)
+			}
+			if (decoded.Created == nil) != (test.cursor.Created == nil) ||
+				(decoded.Created != nil && !decoded.Created.Equal(*test.cursor.Created)) {
+				t.Errorf("created = %v, want %v", decoded.Created, test.cursor.Created)
+			}
+			decoded.Created, test.cursor.Created = nil, nil
+			if !reflect.DeepEqual(decoded, test.cursor) {
+				t.Errorf("DecodeCursor(EncodeCursor(%+v)) = %+v", test.cursor, decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, s := range []string{"not base64!", "bm90IGpzb24", "W10"} {
+		if _, err := DecodeCursor(s); err == nil {
+			t.Errorf("DecodeCursor(%q) succeeded, want an error", s)
+		}
+	}
+}
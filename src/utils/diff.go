@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffLine struct {
+	kind    byte
+	text    string
+	fromPos int
+	toPos   int
+}
+
+func splitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// maxDiffCells bounds the LCS table of diffLines. Changed regions with more line pairs than that
+// are diffed as a whole replacement, which is still a valid diff, just not the smallest one.
+const maxDiffCells = 1 << 20
+
+// diffLines builds the line edit script from a to b. Lines common to the start and the end are
+// matched directly, the rest comes from the longest common subsequence of the changed region.
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for k := 0; k < prefix; k++ {
+		lines = append(lines, diffLine{' ', a[k], k, k})
+	}
+	lines = append(lines, diffChanged(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)...)
+	for k := 0; k < suffix; k++ {
+		i, j := len(a)-suffix+k, len(b)-suffix+k
+		lines = append(lines, diffLine{' ', a[i], i, j})
+	}
+	return lines
+}
+
+// diffChanged diffs the changed region of two texts, which starts at line fromPos of a and toPos of b
+func diffChanged(a, b []string, fromPos, toPos int) []diffLine {
+	lines := make([]diffLine, 0, len(a)+len(b))
+	if len(a)*len(b) > maxDiffCells {
+		for i := range a {
+			lines = append(lines, diffLine{'-', a[i], fromPos + i, toPos})
+		}
+		for j := range b {
+			lines = append(lines, diffLine{'+', b[j], fromPos + len(a), toPos + j})
+		}
+		return lines
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i], fromPos + i, toPos + j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i], fromPos + i, toPos + j})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j], fromPos + i, toPos + j})
+			j++
+		}
+	}
+	return lines
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// UnifiedDiff returns the line diff of two texts in unified format with three lines of context.
+// Equal texts give an empty string.
+func UnifiedDiff(fromName, toName, from, to string) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	var b strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].kind == ' ' {
+			start++
+			continue
+		}
+
+		// a hunk spans changes closer than two contexts to each other
+		end := start
+		for k := start; k < len(lines) && k-end <= 2*diffContext; k++ {
+			if lines[k].kind != ' ' {
+				end = k
+			}
+		}
+		first := start - diffContext
+		if first < 0 {
+			first = 0
+		}
+		last := end + diffContext
+		if last >= len(lines) {
+			last = len(lines) - 1
+		}
+
+		if b.Len() == 0 {
+			fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fromLen, toLen := 0, 0
+		for _, l := range lines[first : last+1] {
+			if l.kind != '+' {
+				fromLen++
+			}
+			if l.kind != '-' {
+				toLen++
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(lines[first].fromPos, fromLen), hunkRange(lines[first].toPos, toLen))
+		for _, l := range lines[first : last+1] {
+			b.WriteByte(l.kind)
+			b.WriteString(l.text)
+			b.WriteByte('\n')
+		}
+		start = last + 1
+	}
+	return b.String()
+}
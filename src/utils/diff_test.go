@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func numberedLines(prefix string, n int) string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = prefix + strconv.Itoa(i)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"equal", "a\nb", "a\nb", ""},
+		{"both empty", "", "", ""},
+		{"changed line", "a\nb\nc", "a\nB\nc", "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"added to empty", "", "x", "--- old\n+++ new\n@@ -0,0 +1 @@\n+x\n"},
+		{"removed all", "x", "", "--- old\n+++ new\n@@ -1 +0,0 @@\n-x\n"},
+		{
+			"close changes share a hunk",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11",
+			"--- old\n+++ new\n@@ -2,9 +2,10 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n 9\n 10\n+11\n",
+		},
+		{
+			"distant changes get own hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve",
+			"--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := UnifiedDiff("old", "new", test.from, test.to)
+			if got != test.want {
+				t.Errorf("UnifiedDiff(%q, %q) = %q, want %q", test.from, test.to, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffTooLarge(t *testing.T) {
+	// the changed regions have far more line pairs than maxDiffCells, so they are replaced as a whole
+	from := "head\n" + numberedLines("a", 3000) + "\ntail"
+	to := "head\n" + numberedLines("b", 3000) + "\ntail"
+
+	got := UnifiedDiff("old", "new", from, to)
+	if !strings.HasPrefix(got, "--- old\n+++ new\n@@ -1,3002 +1,3002 @@\n head\n-a0\n") {
+		t.Fatalf("unexpected diff start %q", got[:64])
+	}
+	if !strings.HasSuffix(got, "\n+b2999\n tail\n") {
+		t.Errorf("unexpected diff end %q", got[len(got)-64:])
+	}
+	if n := strings.Count(got, "\n-"); n != 3000 {
+		t.Errorf("%d removed lines, want 3000", n)
+	}
+	if n := strings.Count(got, "\n+"); n != 3001 {
+		t.Errorf("%d added lines and header, want 3001", n)
+	}
+}
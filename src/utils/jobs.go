@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// DeleteThread removes a thread with everything that references it.
+// Blobs of its attachments are left to PurgeAttachments. Counters are not touched: the thread left them when it was soft-deleted.
+func DeleteThread(tx *pgx.Tx, threadId int) error {
+	_, err := tx.Exec(`
+		DELETE FROM post_revisions
+		WHERE post_id IN (SELECT id FROM posts WHERE thread = $1)`,
+		threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM post_votes
+		WHERE post_id IN (SELECT id FROM posts WHERE thread = $1)`,
+		threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM post_mentions
+		WHERE post_id IN (SELECT id FROM posts WHERE thread = $1)`,
+		threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM attachments
+		WHERE post_id IN (SELECT id FROM posts WHERE thread = $1)`,
+		threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM posts WHERE thread = $1`, threadId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM thread_revisions WHERE thread_id = $1`, threadId)
+	if err != nil {
+		return err
+	}
+
+	err = DeletePoll(tx, threadId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM thread_votes WHERE thread_id = $1`, threadId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM thread_slug_aliases WHERE thread_id = $1`, threadId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM threads WHERE id = $1`, threadId)
+	return err
+}
+
+// DeletePosts removes posts with everything that references them.
+// Replies are not touched, callers delete whole subtrees or leaves only.
+func DeletePosts(tx *pgx.Tx, postIds []int) error {
+	_, err := tx.Exec(`DELETE FROM post_revisions WHERE post_id = ANY($1::int[])`, postIds)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM post_votes WHERE post_id = ANY($1::int[])`, postIds)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM post_mentions WHERE post_id = ANY($1::int[])`, postIds)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM attachments WHERE post_id = ANY($1::int[])`, postIds)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM posts WHERE id = ANY($1::int[])`, postIds)
+	return err
+}
+
+// DeletePoll removes the poll of a thread if it has one
+func DeletePoll(tx *pgx.Tx, threadId int) error {
+	_, err := tx.Exec(`
+		DELETE FROM poll_votes
+		WHERE poll_id IN (SELECT id FROM polls WHERE thread_id = $1)`,
+		threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM poll_options
+		WHERE poll_id IN (SELECT id FROM polls WHERE thread_id = $1)`,
+		threadId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM polls WHERE thread_id = $1`, threadId)
+	return err
+}
+
+// PurgeDeletedThreads hard-deletes threads that were soft-deleted more than retention ago
+func PurgeDeletedThreads(db *pgx.ConnPool, retention time.Duration) (int, error) {
+	rows, err := db.Query(`
+		SELECT id FROM threads
+		WHERE deleted_at < $1`,
+		time.Now().Add(-retention),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var threadIds []int
+	for rows.Next() {
+		var threadId int
+		rows.Scan(&threadId)
+		threadIds = append(threadIds, threadId)
+	}
+	rows.Close()
+
+	purged := 0
+	for _, threadId := range threadIds {
+		tx, err := db.Begin()
+		if err != nil {
+			return purged, err
+		}
+		err = DeleteThread(tx, threadId)
+		if err != nil {
+			tx.Rollback()
+			return purged, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return purged, err
+		}
+		purged += 1
+	}
+
+	return purged, nil
+}
+
+func StartThreadPurge(db *pgx.ConnPool, retention time.Duration, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			purged, err := PurgeDeletedThreads(db, retention)
+			if err != nil {
+				log.Println(err)
+			}
+			if purged > 0 {
+				log.Printf("Purged %d deleted threads", purged)
+			}
+		}
+	}()
+}
+
+// PurgeAttachments removes uploads that were not attached to a post within maxAge
+// and the blobs no attachment refers to any more
+func PurgeAttachments(db *pgx.ConnPool, storage BlobStorage, maxAge time.Duration) (int, error) {
+	tag, err := db.Exec(`
+		DELETE FROM attachments
+		WHERE post_id IS NULL AND created < $1`,
+		time.Now().Add(-maxAge),
+	)
+	if err != nil {
+		return 0, err
+	}
+	purged := int(tag.RowsAffected())
+
+	rows, err := db.Query(`
+		SELECT sha256 FROM blobs b
+		WHERE NOT EXISTS (SELECT 1 FROM attachments a WHERE a.sha256 = b.sha256)`,
+	)
+	if err != nil {
+		return purged, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		err = purgeBlob(db, storage, key)
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeBlob removes a blob no attachment refers to. Its file goes once the row is gone for good,
+// so a failed commit keeps both. Uploads of the same content wait on the same lock until then
+// and never see the file that is about to be removed.
+func purgeBlob(db *pgx.ConnPool, storage BlobStorage, key string) error {
+	conn, err := db.Acquire()
+	if err != nil {
+		return err
+	}
+	defer db.Release(conn)
+
+	_, err = conn.Exec(`SELECT pg_advisory_lock(hashtext($1))`, key)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(`SELECT pg_advisory_unlock(hashtext($1))`, key)
+
+	tag, err := conn.Exec(`
+		DELETE FROM blobs b
+		WHERE sha256 = $1 AND NOT EXISTS (SELECT 1 FROM attachments a WHERE a.sha256 = b.sha256)`,
+		key,
+	)
+	if err != nil || tag.RowsAffected() == 0 {
+		return err
+	}
+	return storage.Delete(key)
+}
+
+func StartAttachmentGC(db *pgx.ConnPool, storage BlobStorage, maxAge time.Duration, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			purged, err := PurgeAttachments(db, storage, maxAge)
+			if err != nil {
+				log.Println(err)
+			}
+			if purged > 0 {
+				log.Printf("Purged %d unattached uploads", purged)
+			}
+		}
+	}()
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"bytes"
+	stdhtml "html"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// raw HTML in messages is passed through by the renderer and cleaned up by the sanitizer
+var markdown = goldmark.New(goldmark.WithRendererOptions(html.WithUnsafe()))
+
+// the allow-list policy for user content: no scripts, styles, event handlers or non-http(s)/mailto links
+var sanitizer = bluemonday.UGCPolicy()
+
+// RenderMarkdown turns a CommonMark message into sanitized HTML
+func RenderMarkdown(message string) string {
+	var buf bytes.Buffer
+	err := markdown.Convert([]byte(message), &buf)
+	if err != nil {
+		return stdhtml.EscapeString(message)
+	}
+	return sanitizer.Sanitize(buf.String())
+}
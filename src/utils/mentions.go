@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// an @ that does not continue a word, so e-mail addresses are not mentions
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.@])@([A-Za-z0-9_.]+)`)
+
+// ExtractMentions returns the @nickname tokens of a message, each once. A token may end with dots
+// that close the sentence rather than belong to the nickname, mentionSpellings tells them apart.
+func ExtractMentions(message string) []string {
+	tokens := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(message, -1) {
+		key := strings.ToLower(match[1])
+		if seen[key] || len(strings.TrimRight(match[1], ".")) == 0 {
+			continue
+		}
+		seen[key] = true
+		tokens = append(tokens, match[1])
+	}
+	return tokens
+}
+
+// mentionSpellings lists the nicknames a token may stand for, longest first:
+// the token itself and the token without one, two and more of its trailing dots
+func mentionSpellings(token string) []string {
+	spellings := []string{token}
+	for strings.HasSuffix(token, ".") {
+		token = token[:len(token)-1]
+		if len(token) == 0 {
+			break
+		}
+		spellings = append(spellings, token)
+	}
+	return spellings
+}
+
+// SaveMentions replaces the mentions of posts with the users referenced by their messages.
+// A token mentions the longest of its spellings that belongs to somebody, tokens that match
+// nobody stay plain text.
+func SaveMentions(tx *pgx.Tx, postIds []int, messages []string) error {
+	_, err := tx.Exec(`DELETE FROM post_mentions WHERE post_id = ANY($1::int[])`, postIds)
+	if err != nil {
+		return err
+	}
+
+	mentionPosts := make([]int, 0)
+	mentionTokens := make([]string, 0)
+	mentionNicknames := make([]string, 0)
+	for i, postId := range postIds {
+		for _, token := range ExtractMentions(messages[i]) {
+			for _, nickname := range mentionSpellings(token) {
+				mentionPosts = append(mentionPosts, postId)
+				mentionTokens = append(mentionTokens, token)
+				mentionNicknames = append(mentionNicknames, nickname)
+			}
+		}
+	}
+	if len(mentionPosts) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO post_mentions (post_id, user_id)
+		SELECT DISTINCT ON (m.post_id, m.token) m.post_id, u.id
+		FROM unnest($1::int[], $2::text[], $3::text[]) AS m (post_id, token, nickname)
+			INNER JOIN users u ON u.nickname = m.nickname::citext
+		ORDER BY m.post_id, m.token, length(m.nickname) DESC
+		ON CONFLICT (post_id, user_id) DO NOTHING`,
+		mentionPosts, mentionTokens, mentionNicknames,
+	)
+	return err
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractMentions(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []string
+	}{
+		{"no mentions here", []string{}},
+		{"@alice hi", []string{"alice"}},
+		{"thanks @bob.", []string{"bob."}},
+		{"@j.doe and @J.Doe", []string{"j.doe"}},
+		{"cc @alice, @bob_1 (@carol)", []string{"alice", "bob_1", "carol"}},
+		{"mail me at alice@example.com", []string{}},
+		{"@@alice", []string{}},
+		{"a lone @ and @...", []string{}},
+		{"line\n@dave", []string{"dave"}},
+	}
+	for _, test := range tests {
+		t.Run(test.message, func(t *testing.T) {
+			got := ExtractMentions(test.message)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ExtractMentions(%q) = %q, want %q", test.message, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMentionSpellings(t *testing.T) {
+	tests := []struct {
+		token string
+		want  []string
+	}{
+		{"bob", []string{"bob"}},
+		{"bob.", []string{"bob.", "bob"}},
+		{"j.doe..", []string{"j.doe..", "j.doe.", "j.doe"}},
+	}
+	for _, test := range tests {
+		t.Run(test.token, func(t *testing.T) {
+			got := mentionSpellings(test.token)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mentionSpellings(%q) = %q, want %q", test.token, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const MaxSlugLength = 64
+
+// ReservedSlugs can not be used as thread slugs: they clash with routes or are likely to in the future
+var ReservedSlugs = []string{
+	"admin", "api", "create", "delete", "details", "edit", "export", "history", "import", "merge", "moderate",
+	"move", "new", "poll", "posts", "rename", "restore", "split", "tags", "trash", "users", "vote", "votes",
+}
+
+var transliteration = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+
+	// latin letters that do not decompose into a base letter and marks
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'þ': "th", 'ł': "l", 'ı': "i",
+}
+
+// latinize spells a lowercase rune in ASCII letters and digits. Runes without a transliteration are
+// decomposed (NFKD) and keep their ASCII base, so accents are dropped and compatibility forms are folded.
+// It reports false for runes that have no such spelling, a lone combining mark is spelled as nothing.
+func latinize(r rune) (string, bool) {
+	if latin, ok := transliteration[r]; ok {
+		return latin, true
+	}
+	if unicode.Is(unicode.Mn, r) {
+		return "", true
+	}
+	var b strings.Builder
+	for _, d := range norm.NFKD.String(string(r)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		if d >= unicode.MaxASCII || !(unicode.IsLetter(d) || unicode.IsDigit(d)) {
+			return "", false
+		}
+		b.WriteRune(unicode.ToLower(d))
+	}
+	return b.String(), b.Len() > 0
+}
+
+func IsReservedSlug(slug string) bool {
+	return StringInList(strings.ToLower(slug), ReservedSlugs)
+}
+
+func IsNumericSlug(slug string) bool {
+	_, err := strconv.Atoi(slug)
+	return err == nil
+}
+
+// Slugify makes a lowercase latin slug out of a title, transliterating cyrillic letters and
+// stripping accents off latin ones. Anything else that is not a letter or a digit separates words.
+// The result is never empty, purely numeric or reserved.
+func Slugify(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		latin, ok := latinize(r)
+		if !ok {
+			dash = b.Len() > 0
+			continue
+		}
+		if len(latin) == 0 {
+			continue
+		}
+		if dash {
+			b.WriteByte('-')
+			dash = false
+		}
+		b.WriteString(latin)
+	}
+
+	slug := b.String()
+	if len(slug) > MaxSlugLength {
+		slug = slug[:MaxSlugLength]
+		if i := strings.LastIndexByte(slug, '-'); i > MaxSlugLength/2 {
+			slug = slug[:i]
+		}
+		slug = strings.TrimRight(slug, "-")
+	}
+	if len(slug) == 0 || IsReservedSlug(slug) || IsNumericSlug(slug) {
+		slug = strings.TrimRight("thread-"+slug, "-")
+	}
+	return slug
+}
+
+// UniqueSlug appends the smallest -N suffix that makes slug differ from all the taken ones
+func UniqueSlug(slug string, taken []string) string {
+	used := make(map[string]bool, len(taken))
+	for _, t := range taken {
+		used[strings.ToLower(t)] = true
+	}
+	if !used[slug] {
+		return slug
+	}
+	for n := 2; ; n++ {
+		candidate := slug + "-" + strconv.Itoa(n)
+		if !used[candidate] {
+			return candidate
+		}
+	}
+}
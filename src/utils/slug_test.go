@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Hello, World!", "hello-world"},
+		{"  Go   modules  ", "go-modules"},
+		{"Café crème brûlée", "cafe-creme-brulee"},
+		{"Cafe\u0301 noir", "cafe-noir"},
+		{"Ångström Łódź", "angstrom-lodz"},
+		{"Straße", "strasse"},
+		{"Ｆｕｌｌｗｉｄｔｈ ﬁle", "fullwidth-file"},
+		{"Привет, мир", "privet-mir"},
+		{"Съезд ёжиков", "sezd-yozhikov"},
+		{"Йога", "yoga"},
+		{"日本語", "thread"},
+		{"", "thread"},
+		{"12345", "thread-12345"},
+		{"Admin", "thread-admin"},
+		{strings.Repeat("word ", 20), strings.TrimSuffix(strings.Repeat("word-", 12), "-")},
+	}
+	for _, test := range tests {
+		t.Run(test.title, func(t *testing.T) {
+			got := Slugify(test.title)
+			if got != test.want {
+				t.Errorf("Slugify(%q) = %q, want %q", test.title, got, test.want)
+			}
+			if len(got) > MaxSlugLength {
+				t.Errorf("Slugify(%q) is %d bytes long, more than %d", test.title, len(got), MaxSlugLength)
+			}
+		})
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	tests := []struct {
+		name  string
+		slug  string
+		taken []string
+		want  string
+	}{
+		{"free", "go", nil, "go"},
+		{"unrelated taken", "go", []string{"golang", "go-3"}, "go"},
+		{"taken", "go", []string{"go"}, "go-2"},
+		{"taken in other case", "go", []string{"GO"}, "go-2"},
+		{"smallest free suffix", "go", []string{"go", "go-2", "go-4"}, "go-3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := UniqueSlug(test.slug, test.taken)
+			if got != test.want {
+				t.Errorf("UniqueSlug(%q, %q) = %q, want %q", test.slug, test.taken, got, test.want)
+			}
+		})
+	}
+}
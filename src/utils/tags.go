@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"strings"
+)
+
+const MaxTagLength = 64
+
+// NormalizeTags trims tags, drops empty ones and removes duplicates case-insensitively,
+// keeping the first spelling the same way CITEXT columns compare them
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if len(tag) == 0 || len(tag) > MaxTagLength {
+			continue
+		}
+		key := strings.ToLower(tag)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
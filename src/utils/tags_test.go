@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	long := make([]byte, MaxTagLength+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{"nil", nil, []string{}},
+		{"trimmed", []string{"  go  ", "sql"}, []string{"go", "sql"}},
+		{"inner spaces collapsed", []string{"data   base"}, []string{"data base"}},
+		{"empty dropped", []string{"", "   ", "go"}, []string{"go"}},
+		{"duplicates keep first spelling", []string{"Go", "go", "GO", "sql"}, []string{"Go", "sql"}},
+		{"too long dropped", []string{string(long), "go"}, []string{"go"}},
+		{"longest allowed kept", []string{string(long[1:])}, []string{string(long[1:])}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NormalizeTags(test.tags)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("NormalizeTags(%q) = %q, want %q", test.tags, got, test.want)
+			}
+		})
+	}
+}
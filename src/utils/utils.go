@@ -31,6 +31,12 @@ func IntInList(i int, list []int) bool {
 	return false
 }
 
+// IsUniqueViolation reports whether a statement failed on a unique constraint
+func IsUniqueViolation(err error) bool {
+	pgErr, ok := err.(pgx.PgError)
+	return ok && pgErr.Code == "23505"
+}
+
 func PostgresConnect(host string, port int, db_name string, username string, password string) (*pgx.ConnPool, error) {
 	log.Println("Connecting to the database!")
 	dsn := fmt.Sprintf("user=%s password=%s host=%s port=%d dbname=%s sslmode=disable", username, password, host, port, db_name)
@@ -82,6 +88,21 @@ func PrepareQueries(db *pgx.ConnPool) error {
 
 func ClearTables(db *pgx.ConnPool) error {
 	_, err := db.Exec(`
+		DELETE FROM forum_invites;
+		DELETE FROM forum_members;
+		DELETE FROM thread_slug_aliases;
+		DELETE FROM forum_slug_aliases;
+		DELETE FROM forum_stats_authors;
+		DELETE FROM forum_stats;
+		DELETE FROM poll_votes;
+		DELETE FROM poll_options;
+		DELETE FROM polls;
+		DELETE FROM attachments;
+		DELETE FROM blobs;
+		DELETE FROM post_mentions;
+		DELETE FROM post_votes;
+		DELETE FROM post_revisions;
+		DELETE FROM thread_revisions;
 		DELETE FROM posts;
 		DELETE FROM thread_votes;
 		DELETE FROM threads;
@@ -94,6 +115,21 @@ func ClearTables(db *pgx.ConnPool) error {
 
 func ClearDB(db *pgx.ConnPool) error {
 	_, err := db.Exec(`
+		DROP TABLE IF EXISTS forum_invites;
+		DROP TABLE IF EXISTS forum_members;
+		DROP TABLE IF EXISTS thread_slug_aliases;
+		DROP TABLE IF EXISTS forum_slug_aliases;
+		DROP TABLE IF EXISTS forum_stats_authors;
+		DROP TABLE IF EXISTS forum_stats;
+		DROP TABLE IF EXISTS poll_votes;
+		DROP TABLE IF EXISTS poll_options;
+		DROP TABLE IF EXISTS polls;
+		DROP TABLE IF EXISTS attachments;
+		DROP TABLE IF EXISTS blobs;
+		DROP TABLE IF EXISTS post_mentions;
+		DROP TABLE IF EXISTS post_votes;
+		DROP TABLE IF EXISTS post_revisions;
+		DROP TABLE IF EXISTS thread_revisions;
 		DROP TABLE IF EXISTS posts;
 		DROP TABLE IF EXISTS thread_votes;
 		DROP TABLE IF EXISTS threads;
@@ -125,6 +161,7 @@ func CreateTables(db *pgx.ConnPool) error {
             slug CITEXT UNIQUE,
 			threads INT DEFAULT 0,
 			posts INT DEFAULT 0,
+			is_private BOOLEAN DEFAULT false,
 
 			FOREIGN KEY (user_nickname) REFERENCES users (nickname)
         );
@@ -133,6 +170,10 @@ func CreateTables(db *pgx.ConnPool) error {
 		CREATE UNLOGGED TABLE IF NOT EXISTS forum_users (
 			forum_id INT,
 			user_id INT,
+			posts INT DEFAULT 0,
+			threads INT DEFAULT 0,
+			first_active TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			last_active TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 
 			UNIQUE(forum_id, user_id),
 
@@ -140,6 +181,8 @@ func CreateTables(db *pgx.ConnPool) error {
 			FOREIGN KEY (user_id) REFERENCES users (id)
 		);
 		CREATE INDEX IF NOT EXISTS forum_users_forum_id ON forum_users (forum_id);
+		CREATE INDEX IF NOT EXISTS forum_users_forum_posts ON forum_users (forum_id, posts);
+		CREATE INDEX IF NOT EXISTS forum_users_forum_last_active ON forum_users (forum_id, last_active);
 
         CREATE UNLOGGED TABLE IF NOT EXISTS threads (
             id SERIAL PRIMARY KEY,
@@ -150,13 +193,32 @@ func CreateTables(db *pgx.ConnPool) error {
             created TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
             votes INT DEFAULT 0,
             slug CITEXT,
-
-			FOREIGN KEY (forum) REFERENCES forums (slug),
+            deleted_at TIMESTAMP WITH TIME ZONE,
+            pinned BOOLEAN DEFAULT false,
+            locked BOOLEAN DEFAULT false,
+            announcement BOOLEAN DEFAULT false,
+            tags CITEXT[] DEFAULT '{}',
+            posts INT DEFAULT 0,
+            last_post_at TIMESTAMP WITH TIME ZONE,
+            last_post_author CITEXT,
+            upvotes INT DEFAULT 0,
+            downvotes INT DEFAULT 0,
+            views INT DEFAULT 0,
+            message_html TEXT DEFAULT '',
+
+			FOREIGN KEY (forum) REFERENCES forums (slug) ON UPDATE CASCADE,
 			FOREIGN KEY (author) REFERENCES users (nickname)
         );
 		CREATE INDEX IF NOT EXISTS threads_slug ON threads USING HASH (slug);
+		CREATE UNIQUE INDEX IF NOT EXISTS threads_slug_unique ON threads (slug) WHERE slug <> '';
 		CREATE INDEX IF NOT EXISTS threads_forum ON threads USING HASH (forum);
 		CREATE INDEX IF NOT EXISTS threads_forum_created ON threads (forum, created);
+		CREATE INDEX IF NOT EXISTS threads_forum_pinned_created ON threads (forum, pinned, created);
+		CREATE INDEX IF NOT EXISTS threads_tags ON threads USING GIN (tags);
+		CREATE INDEX IF NOT EXISTS threads_forum_activity ON threads (forum, (COALESCE(last_post_at, created)), id);
+		CREATE INDEX IF NOT EXISTS threads_forum_votes ON threads (forum, votes, id);
+		CREATE INDEX IF NOT EXISTS threads_forum_posts ON threads (forum, posts, id);
+		CREATE INDEX IF NOT EXISTS threads_forum_views ON threads (forum, views, id);
 
         CREATE UNLOGGED TABLE IF NOT EXISTS posts (
             id SERIAL PRIMARY KEY,
@@ -168,18 +230,68 @@ func CreateTables(db *pgx.ConnPool) error {
             forum CITEXT,
             thread INT,
             created TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+            deleted_at TIMESTAMP WITH TIME ZONE,
+            score INT DEFAULT 0,
+            message_html TEXT DEFAULT '',
 
 			FOREIGN KEY (author) REFERENCES users (nickname),
-			FOREIGN KEY (forum) REFERENCES forums (slug),
+			FOREIGN KEY (forum) REFERENCES forums (slug) ON UPDATE CASCADE,
 			FOREIGN KEY (thread) REFERENCES threads (id)
         );
 		CREATE INDEX IF NOT EXISTS post_thread ON posts (thread);
 		CREATE INDEX IF NOT EXISTS post_thread_id ON posts (thread, id);
+		CREATE INDEX IF NOT EXISTS post_thread_parent ON posts (thread, parent);
 		CREATE INDEX IF NOT EXISTS post_thread_parent_path2 ON posts (thread, parent, (path[2]));
 
 		CREATE INDEX IF NOT EXISTS post_path2 on posts ((path[2]));
 		CREATE INDEX IF NOT EXISTS post_path2_path ON posts ((path[2]) DESC, path ASC);
 		CREATE INDEX IF NOT EXISTS post_path ON posts (path ASC);
+		CREATE INDEX IF NOT EXISTS post_thread_roots_score ON posts (thread, score DESC, id) WHERE parent = 0;
+		CREATE INDEX IF NOT EXISTS post_forum_created ON posts (forum, created DESC, id DESC);
+		CREATE INDEX IF NOT EXISTS post_forum_author_created ON posts (forum, author, created DESC, id DESC);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS post_votes (
+			post_id INT,
+			user_id INT,
+			voice INT,
+
+			UNIQUE(post_id, user_id),
+
+			FOREIGN KEY (post_id) REFERENCES posts (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS post_mentions (
+			post_id INT,
+			user_id INT,
+
+			UNIQUE(post_id, user_id),
+
+			FOREIGN KEY (post_id) REFERENCES posts (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+		CREATE INDEX IF NOT EXISTS post_mentions_user ON post_mentions (user_id, post_id);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS blobs (
+			sha256 TEXT PRIMARY KEY,
+			size INT,
+			content_type TEXT
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS attachments (
+			id SERIAL PRIMARY KEY,
+			sha256 TEXT,
+			filename TEXT,
+			uploader CITEXT,
+			post_id INT,
+			created TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+			FOREIGN KEY (sha256) REFERENCES blobs (sha256),
+			FOREIGN KEY (uploader) REFERENCES users (nickname),
+			FOREIGN KEY (post_id) REFERENCES posts (id)
+		);
+		CREATE INDEX IF NOT EXISTS attachments_post ON attachments (post_id);
+		CREATE INDEX IF NOT EXISTS attachments_unattached ON attachments (created) WHERE post_id IS NULL;
 
 		CREATE UNLOGGED TABLE IF NOT EXISTS thread_votes (
 			id SERIAL PRIMARY KEY,
@@ -190,7 +302,127 @@ func CreateTables(db *pgx.ConnPool) error {
 			FOREIGN KEY (thread_id) REFERENCES threads (id),
 			FOREIGN KEY (user_id) REFERENCES users (id)
 		);
-		CREATE INDEX IF NOT EXISTS thread_votes_thread_nickname ON thread_votes (thread_id, user_id);
+		DROP INDEX IF EXISTS thread_votes_thread_nickname;
+		CREATE UNIQUE INDEX IF NOT EXISTS thread_votes_thread_user ON thread_votes (thread_id, user_id);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS forum_members (
+			forum_id INT,
+			user_id INT,
+
+			UNIQUE(forum_id, user_id),
+
+			FOREIGN KEY (forum_id) REFERENCES forums (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS forum_invites (
+			forum_id INT,
+			user_id INT,
+			invited_by INT,
+			created TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+			UNIQUE(forum_id, user_id),
+
+			FOREIGN KEY (forum_id) REFERENCES forums (id),
+			FOREIGN KEY (user_id) REFERENCES users (id),
+			FOREIGN KEY (invited_by) REFERENCES users (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS forum_slug_aliases (
+			slug CITEXT PRIMARY KEY,
+			forum_id INT,
+
+			FOREIGN KEY (forum_id) REFERENCES forums (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS thread_slug_aliases (
+			slug CITEXT PRIMARY KEY,
+			thread_id INT,
+
+			FOREIGN KEY (thread_id) REFERENCES threads (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS forum_stats (
+			forum_id INT,
+			day DATE,
+			threads INT DEFAULT 0,
+			posts INT DEFAULT 0,
+			votes INT DEFAULT 0,
+
+			UNIQUE(forum_id, day),
+
+			FOREIGN KEY (forum_id) REFERENCES forums (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS forum_stats_authors (
+			forum_id INT,
+			day DATE,
+			user_id INT,
+
+			UNIQUE(forum_id, day, user_id),
+
+			FOREIGN KEY (forum_id) REFERENCES forums (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS thread_revisions (
+			id SERIAL PRIMARY KEY,
+			thread_id INT,
+			editor CITEXT,
+			created TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			title TEXT,
+			message TEXT,
+
+			FOREIGN KEY (thread_id) REFERENCES threads (id),
+			FOREIGN KEY (editor) REFERENCES users (nickname)
+		);
+		CREATE INDEX IF NOT EXISTS thread_revisions_thread ON thread_revisions (thread_id, id);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS post_revisions (
+			id SERIAL PRIMARY KEY,
+			post_id INT,
+			editor CITEXT,
+			created TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			message TEXT,
+
+			FOREIGN KEY (post_id) REFERENCES posts (id),
+			FOREIGN KEY (editor) REFERENCES users (nickname)
+		);
+		CREATE INDEX IF NOT EXISTS post_revisions_post ON post_revisions (post_id, id);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS polls (
+			id SERIAL PRIMARY KEY,
+			thread_id INT UNIQUE,
+			question TEXT,
+			multiple BOOLEAN DEFAULT false,
+			closes_at TIMESTAMP WITH TIME ZONE,
+
+			FOREIGN KEY (thread_id) REFERENCES threads (id)
+		);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS poll_options (
+			id SERIAL PRIMARY KEY,
+			poll_id INT,
+			position INT,
+			text TEXT,
+			votes INT DEFAULT 0,
+
+			FOREIGN KEY (poll_id) REFERENCES polls (id)
+		);
+		CREATE INDEX IF NOT EXISTS poll_options_poll ON poll_options (poll_id, position);
+
+		CREATE UNLOGGED TABLE IF NOT EXISTS poll_votes (
+			poll_id INT,
+			option_id INT,
+			user_id INT,
+
+			UNIQUE(option_id, user_id),
+
+			FOREIGN KEY (poll_id) REFERENCES polls (id),
+			FOREIGN KEY (option_id) REFERENCES poll_options (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+		CREATE INDEX IF NOT EXISTS poll_votes_poll_user ON poll_votes (poll_id, user_id);
 
 		CREATE UNLOGGED TABLE IF NOT EXISTS status (
 			users INT,
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ViewCounter aggregates thread views in memory so reads do not update threads.
+// A viewer is counted once per thread within the window.
+type ViewCounter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[int]int
+	seen    map[string]time.Time
+}
+
+// ThreadViews is the counter fed by thread reads and flushed by StartViewFlush
+var ThreadViews = NewViewCounter(time.Hour)
+
+func NewViewCounter(window time.Duration) *ViewCounter {
+	return &ViewCounter{
+		window:  window,
+		pending: make(map[int]int),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Hit counts a view of the thread by viewer, a nickname or an IP address
+func (v *ViewCounter) Hit(threadId int, viewer string) {
+	key := strconv.Itoa(threadId) + "/" + viewer
+	now := time.Now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if last, ok := v.seen[key]; ok && now.Sub(last) < v.window {
+		return
+	}
+	v.seen[key] = now
+	v.pending[threadId]++
+}
+
+// Reset drops counted views that were not flushed yet, e.g. when the database is cleared
+func (v *ViewCounter) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.pending = make(map[int]int)
+	v.seen = make(map[string]time.Time)
+}
+
+// Flush adds the views counted since the last flush to threads in a single update
+func (v *ViewCounter) Flush(db *pgx.ConnPool) error {
+	v.mu.Lock()
+	pending := v.pending
+	v.pending = make(map[int]int)
+	cutoff := time.Now().Add(-v.window)
+	for key, last := range v.seen {
+		if last.Before(cutoff) {
+			delete(v.seen, key)
+		}
+	}
+	v.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	threadIds := make([]int, 0, len(pending))
+	views := make([]int, 0, len(pending))
+	for threadId, n := range pending {
+		threadIds = append(threadIds, threadId)
+		views = append(views, n)
+	}
+
+	_, err := db.Exec(`
+		UPDATE threads t SET views = t.views + v.n
+		FROM unnest($1::int[], $2::int[]) AS v (id, n)
+		WHERE t.id = v.id`,
+		threadIds, views,
+	)
+	if err != nil {
+		// keep the views for the next attempt
+		v.mu.Lock()
+		for threadId, n := range pending {
+			v.pending[threadId] += n
+		}
+		v.mu.Unlock()
+	}
+	return err
+}
+
+func StartViewFlush(db *pgx.ConnPool, counter *ViewCounter, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			err := counter.Flush(db)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}